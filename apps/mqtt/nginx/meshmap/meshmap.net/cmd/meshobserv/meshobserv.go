@@ -1,7 +1,8 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,7 +10,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"regexp"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -21,25 +23,160 @@ import (
 )
 
 const (
-	NodeExpiration     = 86400 // 4 hr
-	NeighborExpiration = 14400 // 4 hr
-	MetricsExpiration  = 14400 // 4 hr
-	PruneWriteInterval = 60 * time.Second
-	RateLimitCount     = 4000
-	RateLimitDuration  = time.Hour
+	NodeExpiration        = 86400 // 4 hr
+	NeighborExpiration    = 14400 // 4 hr
+	MetricsExpiration     = 14400 // 4 hr
+	PruneWriteInterval    = 60 * time.Second
+	DedupeExpiration      = 10 * time.Minute
+	RateLimitCount        = 4000
+	TopicRateLimitCount   = 0 // disabled
+	GatewayRateLimitCount = 20000
+	RateLimitDuration     = time.Hour
+	ListReloadInterval    = 10 * time.Second
+	S3FetchInterval       = 5 * time.Minute
+	S3FetchTimeout        = time.Minute
+	PaxExpiration         = 345600 // 4 days
+	DensityCellSize       = 2000   // degrees * 1e-7, about 20 m
+	RangeTestBinSize      = 100    // m
+	DetectionDebounce     = 30 * time.Second
+	TrackExpiration       = 24 * time.Hour
+	TrackMinDistance      = 25 // m
+	TrackMinInterval      = 5 * time.Minute
+	KeyPinExpiration      = 7 * 24 * time.Hour
+	DeadLetterMaxSize     = 64 << 20 // bytes, twice that with the rotated file
 )
 
 var (
 	Nodes      meshtastic.NodeDB
+	Keys       meshtastic.KeyDB               // guarded by NodesMutex
+	Routes     meshtastic.RouteLog            // guarded by NodesMutex
+	Waypoints  meshtastic.WaypointDB          // guarded by NodesMutex
+	Pax        meshtastic.PaxDB               // guarded by NodesMutex
+	Tracks     = meshtastic.NewTrackDB()      // guarded by NodesMutex
+	Deliveries = meshtastic.NewDeliveryLog()  // guarded by NodesMutex
+	Chat       *meshtastic.ChatArchive        // nil unless channels are opted in
+	Tak        = meshtastic.NewTakDB()        // guarded by NodesMutex
+	TakServer  *meshtastic.CoTSender          // nil unless configured
+	RangeTests = meshtastic.NewRangeTestLog() // guarded by NodesMutex
+	Alerts     *meshtastic.AlertFeed          // guarded by NodesMutex
 	NodesMutex sync.Mutex
 	Receiving  atomic.Bool
 )
 
-func handleMessage(from uint32, topic string, portNum generated.PortNum, payload []byte) {
+// track thinning, set from flags
+var (
+	TrackDistance float64
+	TrackInterval time.Duration
+)
+
+// how long a pinned public key must go unseen to be replaced, set from flags
+var KeyPinTTL time.Duration
+
+// getNode returns the sending node of packet, adding it to Nodes if needed.
+// NodesMutex must be held.
+func getNode(packet *meshtastic.Packet) *meshtastic.Node {
+	node := Nodes[packet.From]
+	if node == nil {
+		node = meshtastic.NewNode()
+		Nodes[packet.From] = node
+	}
+	node.UpdateChannel(packet.Channel)
+	return node
+}
+
+// checkPublicKey pins or verifies the public key a node announced at seen,
+// flagging the node as a suspected impostor on mismatch. NodesMutex must be held.
+func checkPublicKey(node *meshtastic.Node, from uint32, pubKey string, seen int64) bool {
+	if len(pubKey) == 0 {
+		return true
+	}
+	if Keys.Check(from, pubKey, seen, int64(KeyPinTTL.Seconds())) {
+		if node.KeyConflict == pubKey {
+			// the conflicting key was pinned in place of one gone unseen
+			node.ClearKeyConflict()
+		}
+		return true
+	}
+	log.Printf("[warn] node %v announced public key %v, pinned %v", from, pubKey, Keys.Pinned(from))
+	node.UpdateKeyConflict(pubKey, seen)
+	return false
+}
+
+// pkiPublicKey returns the key to decrypt a PKI packet from nodeNum with: the
+// pinned key, or the key the packet carries if none is pinned yet. A carried
+// key other than the pinned one is recorded as a key conflict, unless it
+// replaces an expired pin.
+func pkiPublicKey(nodeNum uint32, packetKey []byte, received int64) ([]byte, bool) {
+	NodesMutex.Lock()
+	defer NodesMutex.Unlock()
+	pinned := Keys.Pinned(nodeNum)
+	if len(pinned) == 0 {
+		return packetKey, true
+	}
+	if len(packetKey) > 0 && formatPublicKey(packetKey) != pinned {
+		node := Nodes[nodeNum]
+		if node == nil {
+			node = meshtastic.NewNode()
+			Nodes[nodeNum] = node
+		}
+		if !checkPublicKey(node, nodeNum, formatPublicKey(packetKey), received) {
+			return nil, false
+		}
+		return packetKey, true
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(pinned, "0x"))
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+// formatPublicKey formats a public key the way it is stored on Node.
+func formatPublicKey(pubKey []byte) string {
+	if len(pubKey) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("0x%x", pubKey)
+}
+
+func handleReception(packet *meshtastic.Packet, rx *meshtastic.Reception) {
+	NodesMutex.Lock()
+	node := getNode(packet)
+	node.UpdateSeenBy(rx, packet.PortNum.String())
+	if packet.PortNum == generated.PortNum_RANGE_TEST_APP && packet.IsBroadcast() {
+		// every gateway hearing a range test packet counts
+		if seq, ok := meshtastic.ParseRangeTestSeq(packet.Payload); ok {
+			RangeTests.Add(packet.From, seq, rx, node.Latitude, node.Longitude)
+		}
+	}
+	NodesMutex.Unlock()
+}
+
+func handleMessage(packet *meshtastic.Packet) {
+	from, topic, portNum, payload := packet.From, packet.Topic, packet.PortNum, packet.Payload
 	Receiving.Store(true)
+	if packet.PKI && len(packet.PublicKey) > 0 {
+		// the key decrypted the packet, so pin it if it is the first one seen
+		NodesMutex.Lock()
+		checkPublicKey(getNode(packet), from, formatPublicKey(packet.PublicKey), packet.RxTime())
+		NodesMutex.Unlock()
+	}
 	switch portNum {
 	case generated.PortNum_TEXT_MESSAGE_APP:
 		//log.Printf("[msg] %v (%v) %s: \"%s\"", from, topic, portNum, payload)
+		if Chat != nil {
+			Chat.Add(packet, string(payload))
+		}
+	case generated.PortNum_TEXT_MESSAGE_COMPRESSED_APP:
+		text, err := meshtastic.UnishoxDecompress(payload)
+		if err != nil {
+			log.Printf("[warn] could not decompress text message from %v on %v: %v", from, topic, err)
+			return
+		}
+		//log.Printf("[msg] %v (%v) %s: \"%s\"", from, topic, portNum, text)
+		if Chat != nil {
+			Chat.Add(packet, string(text))
+		}
 	case generated.PortNum_POSITION_APP:
 		var position generated.Position
 		if err := proto.Unmarshal(payload, &position); err != nil {
@@ -55,11 +192,23 @@ func handleMessage(from uint32, topic string, portNum generated.PortNum, payload
 			return
 		}
 		NodesMutex.Lock()
-		if Nodes[from] == nil {
-			Nodes[from] = meshtastic.NewNode(topic)
+		node := getNode(packet)
+		if !node.UpdatePosition(latitude, longitude, altitude, precision, packet.RxTime()) {
+			NodesMutex.Unlock()
+			return
+		}
+		node.UpdatePositionFix(meshtastic.NewPositionFix(&position, packet.RxTime()))
+		// a manual fix is where the node was placed, not where it went
+		if !node.ManualFix {
+			Tracks.Add(from, &meshtastic.TrackPoint{
+				Latitude:  latitude,
+				Longitude: longitude,
+				Altitude:  altitude,
+				Speed:     node.GroundSpeed,
+				PoorFix:   node.PoorFix,
+				Time:      node.LastPosition,
+			}, TrackDistance, int64(TrackInterval.Seconds()))
 		}
-		Nodes[from].UpdatePosition(latitude, longitude, altitude, precision)
-		Nodes[from].UpdateSeenBy(topic)
 		NodesMutex.Unlock()
 	case generated.PortNum_NODEINFO_APP:
 		var user generated.User
@@ -72,17 +221,20 @@ func handleMessage(from uint32, topic string, portNum generated.PortNum, payload
 		shortName := user.GetShortName()
 		hwModel := user.GetHwModel().String()
 		role := user.GetRole().String()
-		pubKey := user.GetPublicKey()
+		pubKey := formatPublicKey(user.GetPublicKey())
 
 		//log.Printf("[msg] %v->%v (%v) %s: {\"%v\" \"%v\" %v %v}", from, id, topic, portNum, longName, shortName, hwModel, role)
 		if len(longName) == 0 {
 			return
 		}
 		NodesMutex.Lock()
-		if Nodes[from] == nil {
-			Nodes[from] = meshtastic.NewNode(topic)
+		node := getNode(packet)
+		// an impostor may send as the node, but can't change who it is
+		if !checkPublicKey(node, from, pubKey, packet.RxTime()) || (len(pubKey) == 0 && len(node.KeyConflict) > 0) {
+			NodesMutex.Unlock()
+			return
 		}
-		Nodes[from].UpdateUser(longName, shortName, hwModel, role, fmt.Sprintf("0x%x", pubKey))
+		node.UpdateUser(longName, shortName, hwModel, role, pubKey, packet.RxTime())
 		NodesMutex.Unlock()
 	case generated.PortNum_TELEMETRY_APP:
 		var telemetry generated.Telemetry
@@ -101,10 +253,8 @@ func handleMessage(from uint32, topic string, portNum generated.PortNum, payload
 			// 	from, topic, portNum, batteryLevel, voltage, chUtil, airUtilTx, uptime,
 			// )
 			NodesMutex.Lock()
-			if Nodes[from] == nil {
-				Nodes[from] = meshtastic.NewNode(topic)
-			}
-			Nodes[from].UpdateDeviceMetrics(batteryLevel, voltage, chUtil, airUtilTx, uptime)
+			node := getNode(packet)
+			node.UpdateDeviceMetrics(batteryLevel, voltage, chUtil, airUtilTx, uptime, packet.RxTime())
 			NodesMutex.Unlock()
 		} else if envMetrics := telemetry.GetEnvironmentMetrics(); envMetrics != nil {
 			temperature := envMetrics.GetTemperature()
@@ -123,10 +273,8 @@ func handleMessage(from uint32, topic string, portNum generated.PortNum, payload
 			// 	windDirection, windSpeed, windGust, radiation, rainfall1, rainfall24,
 			// )
 			NodesMutex.Lock()
-			if Nodes[from] == nil {
-				Nodes[from] = meshtastic.NewNode(topic)
-			}
-			Nodes[from].UpdateEnvironmentMetrics(
+			node := getNode(packet)
+			node.UpdateEnvironmentMetrics(
 				temperature,
 				relativeHumidity,
 				barometricPressure,
@@ -137,8 +285,66 @@ func handleMessage(from uint32, topic string, portNum generated.PortNum, payload
 				radiation,
 				rainfall1,
 				rainfall24,
+				packet.RxTime(),
 			)
 			NodesMutex.Unlock()
+		} else if airQualityMetrics := telemetry.GetAirQualityMetrics(); airQualityMetrics != nil {
+			airQuality := meshtastic.NewAirQuality(airQualityMetrics)
+			// log.Printf(
+			// 	"[msg] %v (%v) %s: AirQualityMetrics{pm2.5: %v; pm10: %v; co2: %v; aqi: %v %v}",
+			// 	from, topic, portNum, airQuality.Pm25Environmental, airQuality.Pm100Environmental,
+			// 	airQuality.Co2, airQuality.Aqi, airQuality.AqiCategory,
+			// )
+			NodesMutex.Lock()
+			node := getNode(packet)
+			node.UpdateAirQuality(airQuality, packet.RxTime())
+			NodesMutex.Unlock()
+		} else if powerMetrics := telemetry.GetPowerMetrics(); powerMetrics != nil {
+			ch1Voltage := powerMetrics.GetCh1Voltage()
+			ch1Current := powerMetrics.GetCh1Current()
+			ch2Voltage := powerMetrics.GetCh2Voltage()
+			ch2Current := powerMetrics.GetCh2Current()
+			ch3Voltage := powerMetrics.GetCh3Voltage()
+			ch3Current := powerMetrics.GetCh3Current()
+			// log.Printf(
+			// 	"[msg] %v (%v) %s: PowerMetrics{ch1: %vV %vmA; ch2: %vV %vmA; ch3: %vV %vmA}",
+			// 	from, topic, portNum, ch1Voltage, ch1Current, ch2Voltage, ch2Current, ch3Voltage, ch3Current,
+			// )
+			NodesMutex.Lock()
+			node := getNode(packet)
+			node.UpdatePowerMetrics(ch1Voltage, ch1Current, ch2Voltage, ch2Current, ch3Voltage, ch3Current, packet.RxTime())
+			NodesMutex.Unlock()
+		} else if healthMetrics := telemetry.GetHealthMetrics(); healthMetrics != nil {
+			heartBpm := healthMetrics.GetHeartBpm()
+			spO2 := healthMetrics.GetSpO2()
+			temperature := healthMetrics.GetTemperature()
+			// not logged, health data is personal
+			NodesMutex.Lock()
+			node := getNode(packet)
+			node.UpdateHealthMetrics(heartBpm, spO2, temperature, packet.RxTime())
+			NodesMutex.Unlock()
+		} else if localStats := telemetry.GetLocalStats(); localStats != nil {
+			stats := &meshtastic.LocalStats{
+				Uptime:          localStats.GetUptimeSeconds(),
+				ChUtil:          localStats.GetChannelUtilization(),
+				AirUtilTx:       localStats.GetAirUtilTx(),
+				PacketsTx:       localStats.GetNumPacketsTx(),
+				PacketsRx:       localStats.GetNumPacketsRx(),
+				PacketsRxBad:    localStats.GetNumPacketsRxBad(),
+				RxDupe:          localStats.GetNumRxDupe(),
+				TxRelay:         localStats.GetNumTxRelay(),
+				TxRelayCanceled: localStats.GetNumTxRelayCanceled(),
+				OnlineNodes:     localStats.GetNumOnlineNodes(),
+				TotalNodes:      localStats.GetNumTotalNodes(),
+			}
+			// log.Printf(
+			// 	"[msg] %v (%v) %s: LocalStats{tx: %v; rx: %v; bad: %v; dupe: %v; chUtil: %v%%; airUtilTx: %v%%}",
+			// 	from, topic, portNum, stats.PacketsTx, stats.PacketsRx, stats.PacketsRxBad, stats.RxDupe, stats.ChUtil, stats.AirUtilTx,
+			// )
+			NodesMutex.Lock()
+			node := getNode(packet)
+			node.UpdateLocalStats(stats, packet.RxTime())
+			NodesMutex.Unlock()
 		}
 	case generated.PortNum_NEIGHBORINFO_APP:
 		var neighborInfo generated.NeighborInfo
@@ -156,15 +362,196 @@ func handleMessage(from uint32, topic string, portNum generated.PortNum, payload
 			return
 		}
 		NodesMutex.Lock()
-		if Nodes[from] == nil {
-			Nodes[from] = meshtastic.NewNode(topic)
-		}
+		node := getNode(packet)
 		for _, neighbor := range neighbors {
 			neighborNum := neighbor.GetNodeId()
 			if neighborNum == 0 {
 				continue
 			}
-			Nodes[from].UpdateNeighborInfo(neighborNum, neighbor.GetSnr())
+			node.UpdateNeighborInfo(neighborNum, neighbor.GetSnr(), packet.RxTime())
+		}
+		NodesMutex.Unlock()
+	case generated.PortNum_TRACEROUTE_APP:
+		if packet.RequestId == 0 {
+			// only replies carry the complete route
+			return
+		}
+		var routeDiscovery generated.RouteDiscovery
+		if err := proto.Unmarshal(payload, &routeDiscovery); err != nil {
+			log.Printf("[warn] could not parse RouteDiscovery payload from %v on %v: %v", from, topic, err)
+			return
+		}
+		// the reply goes from the traceroute destination back to the requester
+		route := meshtastic.NewRoute(
+			packet.To,
+			from,
+			routeDiscovery.GetRoute(),
+			routeDiscovery.GetSnrTowards(),
+			routeDiscovery.GetRouteBack(),
+			routeDiscovery.GetSnrBack(),
+			packet.RxTime(),
+		)
+		// log.Printf("[msg] %v (%v) %s: %v -> %v", from, topic, portNum, route.Forward, route.Back)
+		NodesMutex.Lock()
+		Routes.Add(route)
+		for _, edge := range route.Edges() {
+			if node := Nodes[edge.To]; node != nil {
+				node.UpdateRouteHop(edge.From, edge.Snr, route.Time)
+			}
+		}
+		NodesMutex.Unlock()
+	case generated.PortNum_WAYPOINT_APP:
+		if packet.PKI {
+			// keep direct messages private
+			return
+		}
+		var waypoint generated.Waypoint
+		if err := proto.Unmarshal(payload, &waypoint); err != nil {
+			log.Printf("[warn] could not parse Waypoint payload from %v on %v: %v", from, topic, err)
+			return
+		}
+		wp := meshtastic.NewWaypoint(
+			waypoint.GetId(),
+			from,
+			packet.Channel,
+			waypoint.GetName(),
+			waypoint.GetDescription(),
+			waypoint.GetIcon(),
+			waypoint.GetLockedTo(),
+			waypoint.GetExpire(),
+			waypoint.GetLatitudeI(),
+			waypoint.GetLongitudeI(),
+			packet.RxTime(),
+		)
+		// log.Printf("[msg] %v (%v) %s: %v \"%v\" (%v, %v)", from, topic, portNum, wp.Id, wp.Name, wp.Latitude, wp.Longitude)
+		if wp.Id == 0 {
+			return
+		}
+		NodesMutex.Lock()
+		if Waypoints.Update(wp) == meshtastic.WaypointLocked {
+			if old := Waypoints[wp.Id]; old != nil {
+				log.Printf("[warn] node %v may not change waypoint %v locked to %v", from, wp.Id, old.LockedTo)
+			}
+		}
+		NodesMutex.Unlock()
+	case generated.PortNum_PAXCOUNTER_APP:
+		var paxcount generated.Paxcount
+		if err := proto.Unmarshal(payload, &paxcount); err != nil {
+			log.Printf("[warn] could not parse Paxcount payload from %v on %v: %v", from, topic, err)
+			return
+		}
+		wifi := paxcount.GetWifi()
+		ble := paxcount.GetBle()
+		uptime := paxcount.GetUptime()
+		// log.Printf("[msg] %v (%v) %s: wifi: %v; ble: %v; uptime: %vs", from, topic, portNum, wifi, ble, uptime)
+		NodesMutex.Lock()
+		node := getNode(packet)
+		node.UpdatePaxcount(wifi, ble, packet.RxTime())
+		Pax.Add(from, wifi, ble, uptime, packet.RxTime())
+		NodesMutex.Unlock()
+	case generated.PortNum_STORE_FORWARD_APP:
+		var storeForward generated.StoreAndForward
+		if err := proto.Unmarshal(payload, &storeForward); err != nil {
+			log.Printf("[warn] could not parse StoreAndForward payload from %v on %v: %v", from, topic, err)
+			return
+		}
+		rr := storeForward.GetRr()
+		// log.Printf("[msg] %v (%v) %s: %v", from, topic, portNum, rr)
+		switch rr {
+		case generated.StoreAndForward_ROUTER_HEARTBEAT,
+			generated.StoreAndForward_ROUTER_STATS,
+			generated.StoreAndForward_ROUTER_HISTORY,
+			generated.StoreAndForward_ROUTER_PING,
+			generated.StoreAndForward_ROUTER_PONG,
+			generated.StoreAndForward_ROUTER_BUSY:
+		default:
+			// only these announce the sender as a router
+			return
+		}
+		NodesMutex.Lock()
+		sf := getNode(packet).UpdateStoreForward(packet.RxTime())
+		if heartbeat := storeForward.GetHeartbeat(); heartbeat != nil {
+			sf.UpdateHeartbeat(heartbeat.GetPeriod(), heartbeat.GetSecondary(), packet.RxTime())
+		} else if stats := storeForward.GetStats(); stats != nil {
+			sf.UpdateStats(
+				stats.GetMessagesTotal(),
+				stats.GetMessagesSaved(),
+				stats.GetMessagesMax(),
+				stats.GetUpTime(),
+				stats.GetRequests(),
+				stats.GetRequestsHistory(),
+				stats.GetReturnMax(),
+				stats.GetReturnWindow(),
+				packet.RxTime(),
+			)
+		} else if history := storeForward.GetHistory(); history != nil && rr == generated.StoreAndForward_ROUTER_HISTORY {
+			sf.UpdateHistory(history.GetHistoryMessages(), packet.RxTime())
+		}
+		NodesMutex.Unlock()
+	case generated.PortNum_ROUTING_APP:
+		if packet.RequestId == 0 {
+			return
+		}
+		var routing generated.Routing
+		if err := proto.Unmarshal(payload, &routing); err != nil {
+			log.Printf("[warn] could not parse Routing payload from %v on %v: %v", from, topic, err)
+			return
+		}
+		if _, ok := routing.GetVariant().(*generated.Routing_ErrorReason); !ok {
+			return
+		}
+		reason := routing.GetErrorReason()
+		// log.Printf("[msg] %v->%v (%v) %s: %v for %v", from, packet.To, topic, portNum, reason, packet.RequestId)
+		NodesMutex.Lock()
+		Deliveries.Add(packet, reason)
+		NodesMutex.Unlock()
+	case generated.PortNum_ATAK_PLUGIN:
+		tak, err := meshtastic.UnmarshalTAKPacket(payload)
+		if err != nil {
+			log.Printf("[warn] could not parse TAKPacket payload from %v on %v: %v", from, topic, err)
+			return
+		}
+		// log.Printf("[msg] %v (%v) %s: %v", from, topic, portNum, tak.GetContact().GetCallsign())
+		if !packet.IsBroadcast() {
+			return
+		}
+		NodesMutex.Lock()
+		entity, chat := Tak.Update(from, tak, packet.RxTime())
+		var events [][]byte
+		if TakServer != nil && tak.GetPli() != nil && entity.LastPli == entity.Updated {
+			if event, err := meshtastic.PliCoT(from, entity); err == nil {
+				events = append(events, event)
+			}
+		}
+		if TakServer != nil && chat != nil {
+			if event, err := meshtastic.ChatCoT(from, packet.Id, entity, chat); err == nil {
+				events = append(events, event)
+			}
+		}
+		NodesMutex.Unlock()
+		for _, event := range events {
+			TakServer.Send(event)
+		}
+	case generated.PortNum_RANGE_TEST_APP:
+		// log.Printf("[msg] %v (%v) %s: \"%s\"", from, topic, portNum, payload)
+		// receptions are counted in handleReception
+	case generated.PortNum_DETECTION_SENSOR_APP:
+		// log.Printf("[msg] %v (%v) %s: \"%s\"", from, topic, portNum, payload)
+		if len(payload) == 0 {
+			return
+		}
+		NodesMutex.Lock()
+		node := getNode(packet)
+		event := &meshtastic.DetectionEvent{
+			From:      from,
+			Text:      string(payload),
+			Channel:   packet.Channel,
+			Latitude:  node.Latitude,
+			Longitude: node.Longitude,
+			Time:      packet.RxTime(),
+		}
+		if Alerts.Add(event) {
+			node.UpdateDetection(event.Text, event.Time)
 		}
 		NodesMutex.Unlock()
 	case generated.PortNum_MAP_REPORT_APP:
@@ -199,24 +586,94 @@ func handleMessage(from uint32, topic string, portNum generated.PortNum, payload
 			return
 		}
 		NodesMutex.Lock()
-		if Nodes[from] == nil {
-			Nodes[from] = meshtastic.NewNode(topic)
+		node := getNode(packet)
+		// map reports carry no key, so can't change who a node in conflict is
+		if len(node.KeyConflict) == 0 {
+			node.UpdateUser(longName, shortName, hwModel, role, "", packet.RxTime())
+		}
+		node.UpdateMapReport(fwVersion, region, modemPreset, hasDefaultCh, onlineLocalNodes, packet.RxTime())
+		if node.UpdatePosition(latitude, longitude, altitude, precision, packet.RxTime()) {
+			// map reports have no fix details, don't keep those of an older position
+			node.ClearPositionFix()
 		}
-		Nodes[from].UpdateUser(longName, shortName, hwModel, role, "")
-		Nodes[from].UpdateMapReport(fwVersion, region, modemPreset, hasDefaultCh, onlineLocalNodes)
-		Nodes[from].UpdatePosition(latitude, longitude, altitude, precision)
-		Nodes[from].UpdateSeenBy(topic)
 		NodesMutex.Unlock()
 	default:
 		// log.Printf("[msg] %v (%v) %s", from, topic, portNum)
 	}
 }
 
+// writeJSON writes v to the file name next to the node database, if any.
+func writeJSON(dbPath, name string, v any) {
+	if len(dbPath) == 0 {
+		return
+	}
+	if err := meshtastic.WriteJSONFile(filepath.Join(filepath.Dir(dbPath), name), v); err != nil {
+		log.Printf("[error] write %v: %v", name, err)
+	}
+}
+
+// writeTracks writes the tracks changed since the last call next to the node
+// database, if any. NodesMutex must be held.
+func writeTracks(dbPath string) {
+	if len(dbPath) == 0 {
+		return
+	}
+	if err := Tracks.WriteFile(filepath.Join(filepath.Dir(dbPath), "tracks.json")); err != nil {
+		log.Printf("[error] write tracks.json: %v", err)
+	}
+	if err := Tracks.WriteDir(filepath.Join(filepath.Dir(dbPath), "tracks"), Nodes); err != nil {
+		log.Printf("[error] write tracks: %v", err)
+	}
+}
+
+// writeNodes writes the valid nodes and the key pins to disk. NodesMutex must be held.
+func writeNodes(dbPath, keysPath string) {
+	if len(dbPath) > 0 {
+		valid := Nodes.GetValid()
+		err := valid.WriteFile(dbPath)
+		if err != nil {
+			log.Fatalf("[error] write nodes: %v", err)
+		}
+		log.Printf("[info] wrote %v nodes to disk", len(valid))
+	}
+	if len(keysPath) > 0 {
+		if err := Keys.WriteFile(keysPath); err != nil {
+			log.Fatalf("[error] write key pins: %v", err)
+		}
+	}
+}
+
 func main() {
-	var dbPath, blockedPath string
+	var dbPath, keysPath, blockedPath, allowedPath, s3CachePath, keyringPath, pkiKeyringPath, brokersPath string
+	var brokerStatePath, deadLetterPath, replayPath string
+	var chatChannels, chatWordsPath, chatHiddenPath, trackedPath string
+	var healthMetricsPath, takServerAddress string
+	var detectionDebounce time.Duration
+	var trackRetention time.Duration
 	flag.StringVar(&dbPath, "f", "", "node database `file`")
+	flag.StringVar(&keysPath, "p", "", "public key pin database `file`")
 	flag.StringVar(&blockedPath, "b", "", "node blocklist `file`")
+	flag.StringVar(&s3CachePath, "s", "", "S3 blocklist cache `file`")
+	flag.StringVar(&allowedPath, "a", "", "node allowlist `file`, exempt from blocklist and rate limits")
+	flag.StringVar(&brokersPath, "m", "", "MQTT broker config `file` (JSON array), instead of MQTT_* variables")
+	flag.StringVar(&brokerStatePath, "broker-state", "", "broker connection state `file`, kept out of the public map directory")
+	flag.StringVar(&keyringPath, "k", "", "channel keyring `file` (one channel=base64psk per line)")
+	flag.StringVar(&pkiKeyringPath, "x", "", "PKI private key `file` (one node=base64key per line)")
+	flag.StringVar(&deadLetterPath, "d", "", "dead letter `file` for envelopes that could not be decoded, rotated to file.1 when full")
+	flag.StringVar(&replayPath, "replay", "", "re-decode the dead letter `file` into the node database, then exit (stop the running meshobserv first)")
+	flag.StringVar(&chatChannels, "c", "", "comma-separated public `channels` to archive broadcast text messages of")
+	flag.StringVar(&chatWordsPath, "w", "", "word filter `file` masking words in archived messages")
+	flag.StringVar(&chatHiddenPath, "hide", "", "moderation hide-list `file` of nodes left out of archived messages")
+	flag.StringVar(&healthMetricsPath, "r", "", "restricted `file` for heart rate, SpO2 and body temperature, readable only by its owner")
+	flag.StringVar(&takServerAddress, "t", "", "send Cursor-on-Target to a TAK server at `address` (tcp://host:port or udp://host:port)")
+	flag.DurationVar(&KeyPinTTL, "key-ttl", KeyPinExpiration, "pin a new public key for a node whose pinned key went unseen for `duration`")
+	flag.DurationVar(&detectionDebounce, "debounce", DetectionDebounce, "ignore repeated detection sensor events within `duration`")
+	flag.StringVar(&trackedPath, "tracks", "", "allowlist `file` of nodes to publish movement tracks of, none without it")
+	flag.DurationVar(&trackRetention, "track-ttl", TrackExpiration, "keep track points for `duration`")
+	flag.Float64Var(&TrackDistance, "track-distance", TrackMinDistance, "skip track points within `meters` of the last one, unless -track-interval passed")
+	flag.DurationVar(&TrackInterval, "track-interval", TrackMinInterval, "add a track point at least every `duration` while the node reports positions")
 	flag.Parse()
+	Alerts = meshtastic.NewAlertFeed(detectionDebounce)
 	// load or make NodeDB
 	if len(dbPath) > 0 {
 		err := Nodes.LoadFile(dbPath)
@@ -228,82 +685,316 @@ func main() {
 	if Nodes == nil {
 		Nodes = make(meshtastic.NodeDB)
 	}
+	// load or make KeyDB
+	if len(keysPath) > 0 {
+		err := Keys.LoadFile(keysPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("[error] load key pins: %v", err)
+		}
+		log.Printf("[info] loaded %v key pins from disk", len(Keys))
+	}
+	if Keys == nil {
+		Keys = make(meshtastic.KeyDB)
+	}
+	// load or make WaypointDB
+	if len(dbPath) > 0 {
+		err := Waypoints.LoadFile(filepath.Join(filepath.Dir(dbPath), "waypoints.json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("[error] load waypoints: %v", err)
+		}
+		log.Printf("[info] loaded %v waypoints from disk", len(Waypoints))
+	}
+	if Waypoints == nil {
+		Waypoints = make(meshtastic.WaypointDB)
+	}
+	// load or make PaxDB
+	if len(dbPath) > 0 {
+		err := Pax.LoadFile(filepath.Join(filepath.Dir(dbPath), "pax.json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("[error] load paxcounts: %v", err)
+		}
+		log.Printf("[info] loaded paxcounts of %v nodes from disk", len(Pax))
+	}
+	if Pax == nil {
+		Pax = make(meshtastic.PaxDB)
+	}
+	// load or make TrackDB
+	if len(dbPath) > 0 {
+		err := Tracks.LoadFile(filepath.Join(filepath.Dir(dbPath), "tracks.json"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("[error] load tracks: %v", err)
+		}
+		log.Printf("[info] loaded tracks of %v nodes from disk", Tracks.Len())
+	}
+	// tracks are opt-in per node, drop any kept from before
+	if len(trackedPath) == 0 {
+		Tracks.SetAllowed(nil)
+	}
+	// pin keys of nodes loaded from disk that were seen before pinning
+	for nodeNum, node := range Nodes {
+		if len(node.PublicKey) > len("0x") && len(Keys.Pinned(nodeNum)) == 0 {
+			Keys.Check(nodeNum, node.PublicKey, node.LastUser, 0)
+		}
+	}
+
+	// optional TAK server feed
+	if len(takServerAddress) > 0 {
+		var err error
+		TakServer, err = meshtastic.NewCoTSender(takServerAddress)
+		if err != nil {
+			log.Fatalf("[error] TAK server: %v", err)
+		}
+	}
+	// opt-in public channel message archive
+	if len(chatChannels) > 0 {
+		Chat = meshtastic.NewChatArchive(strings.Split(chatChannels, ",")...)
+	}
+
+	// admission policy, the block and allow lists are reloaded on change or SIGHUP
+	policy := meshtastic.NewPolicy(
+		meshtastic.Rate{Count: RateLimitCount, Per: RateLimitDuration},
+		meshtastic.Rate{Count: TopicRateLimitCount, Per: RateLimitDuration},
+		meshtastic.Rate{Count: GatewayRateLimitCount, Per: RateLimitDuration},
+	)
+	var lists []*meshtastic.NodeSetFile
+	var setters []func(meshtastic.NodeSet)
+	if len(blockedPath) > 0 {
+		lists = append(lists, &meshtastic.NodeSetFile{Path: blockedPath})
+		setters = append(setters, func(nodes meshtastic.NodeSet) { policy.SetBlocked("file", nodes) })
+	}
+	if len(allowedPath) > 0 {
+		lists = append(lists, &meshtastic.NodeSetFile{Path: allowedPath})
+		setters = append(setters, policy.SetAllowed)
+	}
+	if len(chatHiddenPath) > 0 && Chat != nil {
+		lists = append(lists, &meshtastic.NodeSetFile{Path: chatHiddenPath})
+		setters = append(setters, Chat.SetHidden)
+	}
+	if len(trackedPath) > 0 {
+		lists = append(lists, &meshtastic.NodeSetFile{Path: trackedPath})
+		setters = append(setters, func(nodes meshtastic.NodeSet) {
+			NodesMutex.Lock()
+			Tracks.SetAllowed(nodes)
+			NodesMutex.Unlock()
+		})
+	}
+	var wordsFile *meshtastic.WordFilterFile
+	if len(chatWordsPath) > 0 && Chat != nil {
+		wordsFile = &meshtastic.WordFilterFile{Path: chatWordsPath}
+	}
+	// each list is reloaded on its own, a bad one keeps its last good copy
+	listErrors := make(map[string]string) // logged once until the list loads or SIGHUP
+	listError := func(path string, err error, force bool) {
+		if force || listErrors[path] != err.Error() {
+			log.Printf("[error] load %v: %v", path, err)
+		}
+		listErrors[path] = err.Error()
+	}
+	reloadLists := func(force bool) bool {
+		ok := true
+		for i, list := range lists {
+			nodes, changed, err := list.Reload(force)
+			if err != nil {
+				listError(list.Path, err, force)
+				ok = false
+				continue
+			}
+			delete(listErrors, list.Path)
+			if changed {
+				setters[i](nodes)
+				log.Printf("[info] loaded %v nodes from %v", len(nodes), list.Path)
+			}
+		}
+		if wordsFile != nil {
+			words, changed, err := wordsFile.Reload(force)
+			if err != nil {
+				listError(wordsFile.Path, err, force)
+				ok = false
+			} else {
+				delete(listErrors, wordsFile.Path)
+				if changed {
+					Chat.SetWordFilter(words)
+					log.Printf("[info] loaded %v words from %v", len(words), wordsFile.Path)
+				}
+			}
+		}
+		return ok
+	}
+	if !reloadLists(true) {
+		log.Fatal("[error] could not load all lists")
+	}
+	go func() {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		ticker := time.NewTicker(ListReloadInterval)
+		for {
+			force := false
+			select {
+			case <-hangup:
+				force = true
+			case <-ticker.C:
+			}
+			reloadLists(force)
+		}
+	}()
+	// shared blocklist from S3, cached on disk for offline starts
+	if s3Blocklist, ok := meshtastic.S3NodeSetFromEnv(); ok {
+		if len(s3CachePath) > 0 {
+			nodes, err := meshtastic.LoadNodeSet(s3CachePath)
+			if err == nil {
+				policy.SetBlocked("s3", nodes)
+				log.Printf("[info] loaded %v nodes from %v", len(nodes), s3CachePath)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("[error] load S3 blocklist cache: %v", err)
+			}
+		}
+		go func() {
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), S3FetchTimeout)
+				nodes, err := s3Blocklist.Fetch(ctx)
+				cancel()
+				if err != nil {
+					log.Printf("[error] fetch S3 blocklist: %v", err)
+				} else {
+					policy.SetBlocked("s3", nodes)
+					log.Printf("[info] loaded %v nodes from s3://%v/%v", len(nodes), s3Blocklist.Bucket, s3Blocklist.Prefix)
+					if len(s3CachePath) > 0 {
+						if err := nodes.WriteFile(s3CachePath); err != nil {
+							log.Printf("[error] write S3 blocklist cache: %v", err)
+						}
+					}
+				}
+				time.Sleep(S3FetchInterval)
+			}
+		}()
+	}
 
-	// load node blocklist
-	// blocked := make(map[uint32]struct{})
-	// if len(blockedPath) > 0 {
-	// 	f, err := os.Open(blockedPath)
-	// 	if err != nil {
-	// 		log.Fatalf("[error] open blocklist: %v", err)
-	// 	}
-	// 	s := bufio.NewScanner(f)
-	// 	for s.Scan() {
-	// 		n, err := strconv.ParseUint(s.Text(), 10, 32)
-	// 		if err == nil {
-	// 			blocked[uint32(n)] = struct{}{}
-	// 			log.Printf("[info] node %v blocked", n)
-	// 		}
-	// 	}
-	// 	f.Close()
-	// 	err = s.Err()
-	// 	if err != nil {
-	// 		log.Fatalf("[error] read blocklist: %v", err)
-	// 	}
-	// }
-	// maintain per-node message counters for rate limiting
-	// var counters sync.Map // as map[uint32]*uint32
-	// go func() {
-	// 	for {
-	// 		time.Sleep(RateLimitDuration)
-	// 		log.Print("[info] clearing message counters")
-	// 		counters.Clear()
-	// 	}
-	// }()
+	// load channel keyring
+	keyring := new(meshtastic.Keyring)
+	channelKey := meshtastic.DefaultKey
+	if base64Key := os.Getenv("MQTT_CHANNEL_KEY"); base64Key != "" {
+		key, err := meshtastic.ParseKey(base64Key)
+		if err != nil {
+			log.Fatalf("[error] MQTT_CHANNEL_KEY: %v", err)
+		}
+		keyring.Add("", key)
+		if key != nil {
+			channelKey = key
+		}
+	}
+	if keys := os.Getenv("MQTT_CHANNEL_KEYS"); keys != "" {
+		if err := keyring.Parse(strings.Split(keys, ",")...); err != nil {
+			log.Fatalf("[error] MQTT_CHANNEL_KEYS: %v", err)
+		}
+	}
+	if len(keyringPath) > 0 {
+		if err := keyring.LoadFile(keyringPath); err != nil {
+			log.Fatalf("[error] load keyring: %v", err)
+		}
+	}
+	if keyring.Len() == 0 {
+		keyring.Add("", meshtastic.DefaultKey)
+	}
+	log.Printf("[info] loaded %v channel keys", keyring.Len())
+	// load private keys of our own nodes for PKI direct messages
+	pkiKeyring := new(meshtastic.PKIKeyring)
+	if keys := os.Getenv("MQTT_PKI_KEYS"); keys != "" {
+		if err := pkiKeyring.Parse(strings.Split(keys, ",")...); err != nil {
+			log.Fatalf("[error] MQTT_PKI_KEYS: %v", err)
+		}
+	}
+	if len(pkiKeyringPath) > 0 {
+		if err := pkiKeyring.LoadFile(pkiKeyringPath); err != nil {
+			log.Fatalf("[error] load PKI keyring: %v", err)
+		}
+	}
+	if pkiKeyring.Len() > 0 {
+		log.Printf("[info] loaded %v PKI private keys", pkiKeyring.Len())
+	}
 
-	channelkey := meshtastic.DefaultKey
-	base64Key := os.Getenv("MQTT_CHANNEL_KEY")
-	if base64Key != "" {
-		rawKey, err := base64.StdEncoding.DecodeString(base64Key)
+	// dead letters, for re-decoding with keys learned later
+	var deadLetters *meshtastic.DeadLetterWriter
+	if len(deadLetterPath) > 0 && len(replayPath) == 0 {
+		var err error
+		deadLetters, err = meshtastic.OpenDeadLetters(deadLetterPath, DeadLetterMaxSize)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("[error] open dead letters: %v", err)
+		}
+		defer deadLetters.Close()
+	}
+	dedupe := meshtastic.NewPacketCache(DedupeExpiration)
+	newClient := func(broker meshtastic.Broker) *meshtastic.MQTTClient {
+		return &meshtastic.MQTTClient{
+			Topics: []string{
+				"msh/US/2/e/#",
+				"msh/+/2/map/",
+				"msh/+/2/e/+/+",
+				"msh/+/+/2/map/",
+				"msh/+/+/2/e/+/+",
+				"msh/+/+/+/2/map/",
+				"msh/+/+/+/2/e/+/+",
+				"msh/+/+/+/+/2/map/",
+				"msh/+/+/+/+/2/e/+/+",
+			},
+			Accept:           policy.Accept,
+			AcceptPacket:     policy.AcceptPacket,
+			BlockCipher:      meshtastic.NewBlockCipher(channelKey),
+			Keyring:          keyring,
+			PKIKeyring:       pkiKeyring,
+			PublicKey:        pkiPublicKey,
+			Dedupe:           dedupe,
+			MessageHandler:   handleMessage,
+			ReceptionHandler: handleReception,
+			Broker:           broker,
+			DeadLetters:      deadLetters,
 		}
-		channelkey = rawKey
+	}
+	// re-decode dead letters with the current keyrings, then exit. The running
+	// service must be stopped first, as it would overwrite the result.
+	if len(replayPath) > 0 {
+		log.Printf("[info] replaying %v into %v, meshobserv must not be running", replayPath, dbPath)
+		client := newClient(meshtastic.Broker{})
+		client.Accept = nil
+		client.AcceptPacket = nil
+		count := 0
+		err := meshtastic.ReadDeadLetters(replayPath, func(letter *meshtastic.DeadLetter) {
+			// record each packet as of when it was received
+			client.HandleEnvelope(letter.Topic, letter.Payload, time.Unix(letter.Time, 0))
+			count++
+		})
+		if err != nil {
+			log.Fatalf("[error] read dead letters: %v", err)
+		}
+		log.Printf("[info] replayed %v dead letters, dropped by reason: %v", count, client.Drops())
+		NodesMutex.Lock()
+		writeNodes(dbPath, keysPath)
+		writeJSON(dbPath, "waypoints.json", Waypoints)
+		writeJSON(dbPath, "pax.json", Pax)
+		writeTracks(dbPath)
+		NodesMutex.Unlock()
+		return
 	}
 
-	// connect to MQTT
-	client := &meshtastic.MQTTClient{
-		Topics: []string{
-			"msh/US/2/e/#",
-			"msh/+/2/map/",
-			"msh/+/2/e/+/+",
-			"msh/+/+/2/map/",
-			"msh/+/+/2/e/+/+",
-			"msh/+/+/+/2/map/",
-			"msh/+/+/+/2/e/+/+",
-			"msh/+/+/+/+/2/map/",
-			"msh/+/+/+/+/2/e/+/+",
-		},
-		TopicRegex: regexp.MustCompile(`^msh(?:/[^/]+)+/2/(?:e/[^/]+/![0-9a-f]+|map/)$`),
-		Accept: func(from uint32) bool {
-			// if _, found := blocked[from]; found {
-			// 	return false
-			// }
-			// v, _ := counters.LoadOrStore(from, new(uint32))
-			// count := atomic.AddUint32(v.(*uint32), 1)
-			// if count >= RateLimitCount {
-			// 	if count%100 == 0 {
-			// 		log.Printf("[info] node %v rate limited (%v messages)", from, count)
-			// 	}
-			// 	return false
-			// }
-			return true
-		},
-		BlockCipher:    meshtastic.NewBlockCipher(channelkey),
-		MessageHandler: handleMessage,
+	// connect to MQTT brokers, all feeding the same NodeDB
+	brokers := meshtastic.BrokersFromEnv()
+	if len(brokersPath) > 0 {
+		var err error
+		brokers, err = meshtastic.LoadBrokers(brokersPath)
+		if err != nil {
+			log.Fatalf("[error] load brokers: %v", err)
+		}
 	}
-	err := client.Connect()
-	if err != nil {
-		log.Fatalf("[error] connect: %v", err)
+	var clients []*meshtastic.MQTTClient
+	for _, broker := range brokers {
+		client := newClient(broker)
+		if err := client.Connect(); err != nil {
+			log.Printf("[error] connect %v: %v", broker.Name, err)
+			continue
+		}
+		clients = append(clients, client)
+	}
+	if len(clients) == 0 {
+		log.Fatal("[error] no MQTT brokers to connect to")
 	}
 	// start NodeDB prune and write loop
 	go func() {
@@ -311,15 +1002,66 @@ func main() {
 			time.Sleep(PruneWriteInterval)
 			NodesMutex.Lock()
 			Nodes.Prune(NodeExpiration, NeighborExpiration, MetricsExpiration, NodeExpiration)
-			if len(dbPath) > 0 {
-				valid := Nodes.GetValid()
-				err := valid.WriteFile(dbPath)
-				if err != nil {
-					log.Fatalf("[error] write nodes: %v", err)
+			Routes.Prune(NeighborExpiration)
+			Waypoints.Prune(NodeExpiration)
+			Pax.Prune(PaxExpiration)
+			Tracks.Prune(int64(trackRetention.Seconds()))
+			Deliveries.Prune(NodeExpiration)
+			Tak.Prune(NodeExpiration)
+			RangeTests.Prune(NodeExpiration)
+			Alerts.Prune(NodeExpiration)
+			writeNodes(dbPath, keysPath)
+			writeJSON(dbPath, "routes.json", Nodes.GetRouteGraph(Routes))
+			writeJSON(dbPath, "waypoints.json", Waypoints)
+			writeJSON(dbPath, "pax.json", Pax)
+			writeTracks(dbPath)
+			writeJSON(dbPath, "delivery.json", Deliveries.Report())
+			writeJSON(dbPath, "tak.json", Tak)
+			writeJSON(dbPath, "rangetest.json", RangeTests.Report(Nodes, RangeTestBinSize))
+			writeJSON(dbPath, "alerts.json", Alerts.Events())
+			writeJSON(dbPath, "density.json", Nodes.GetDensityGrid(DensityCellSize))
+			writeJSON(dbPath, "mesh-health.json", Nodes.GetMeshHealth())
+			writeJSON(dbPath, "storeforward.json", Nodes.GetStoreForwardServers())
+			if len(healthMetricsPath) > 0 {
+				if err := meshtastic.WritePrivateJSONFile(healthMetricsPath, Nodes.GetHealthMetrics()); err != nil {
+					log.Printf("[error] write health metrics: %v", err)
+				}
+			}
+			NodesMutex.Unlock()
+			unique, duplicates := dedupe.Stats()
+			log.Printf("[info] received %v unique packets, %v duplicates", unique, duplicates)
+			policy.Prune()
+			for nodeNum, count := range policy.TakeNodeDrops() {
+				log.Printf("[info] node %v dropped (%v messages)", nodeNum, count)
+			}
+			drops := policy.Drops()
+			for _, client := range clients {
+				for reason, count := range client.Drops() {
+					drops[reason] += count
+				}
+			}
+			if len(drops) > 0 {
+				log.Printf("[info] dropped packets by reason: %v", drops)
+			}
+			states := make([]meshtastic.BrokerState, len(clients))
+			for i, client := range clients {
+				states[i] = client.State()
+				if !states[i].Connected {
+					log.Printf("[warn] %v: disconnected since %v: %v", states[i].Name, time.Unix(states[i].Since, 0), states[i].LastError)
+				}
+			}
+			if len(brokerStatePath) > 0 {
+				if err := meshtastic.WriteJSONFile(brokerStatePath, states); err != nil {
+					log.Printf("[error] write broker state: %v", err)
 				}
-				log.Printf("[info] wrote %v nodes to disk", len(valid))
 			}
+			NodesMutex.Lock()
+			regions := Nodes.GetValid().CountByRegion()
 			NodesMutex.Unlock()
+			writeJSON(dbPath, "regions.json", regions)
+			if Chat != nil {
+				writeJSON(dbPath, "chat.json", Chat.Feed())
+			}
 			// if !Receiving.CompareAndSwap(true, false) {
 			// 	log.Fatal("[crit] no messages received")
 			// }
@@ -330,5 +1072,7 @@ func main() {
 	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
 	<-terminate
 	log.Print("[info] exiting")
-	client.Disconnect()
+	for _, client := range clients {
+		client.Disconnect()
+	}
 }
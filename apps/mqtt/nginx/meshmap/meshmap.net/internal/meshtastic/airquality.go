@@ -0,0 +1,113 @@
+package meshtastic
+
+import (
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+)
+
+// US EPA AQI categories
+const (
+	AqiGood               = "good"
+	AqiModerate           = "moderate"
+	AqiUnhealthySensitive = "unhealthySensitive"
+	AqiUnhealthy          = "unhealthy"
+	AqiVeryUnhealthy      = "veryUnhealthy"
+	AqiHazardous          = "hazardous"
+)
+
+type aqiBreakpoint struct {
+	concHigh float64 // µg/m³
+	aqiLow   int32
+	aqiHigh  int32
+	category string
+}
+
+// US EPA breakpoints (2024), concentrations truncated to the sensor's whole µg/m³
+var (
+	pm25Breakpoints = []aqiBreakpoint{
+		{9, 0, 50, AqiGood},
+		{35, 51, 100, AqiModerate},
+		{55, 101, 150, AqiUnhealthySensitive},
+		{125, 151, 200, AqiUnhealthy},
+		{225, 201, 300, AqiVeryUnhealthy},
+		{325, 301, 500, AqiHazardous},
+	}
+	pm100Breakpoints = []aqiBreakpoint{
+		{54, 0, 50, AqiGood},
+		{154, 51, 100, AqiModerate},
+		{254, 101, 150, AqiUnhealthySensitive},
+		{354, 151, 200, AqiUnhealthy},
+		{424, 201, 300, AqiVeryUnhealthy},
+		{604, 301, 500, AqiHazardous},
+	}
+)
+
+func aqi(conc uint32, breakpoints []aqiBreakpoint) (int32, string) {
+	concLow := 0.0
+	for _, bp := range breakpoints {
+		if float64(conc) <= bp.concHigh {
+			index := float64(bp.aqiHigh-bp.aqiLow)/(bp.concHigh-concLow)*(float64(conc)-concLow) + float64(bp.aqiLow)
+			return int32(index + 0.5), bp.category
+		}
+		concLow = bp.concHigh + 1
+	}
+	return 500, AqiHazardous
+}
+
+// AirQuality is an AirQualityMetrics reading. Pm10 is PM1.0, Pm25 PM2.5 and Pm100 PM10,
+// in µg/m³; Particles are counts per 0.1 L of particles larger than the size in µm.
+type AirQuality struct {
+	Pm10Standard       uint32 `json:"pm10Standard,omitempty"`
+	Pm25Standard       uint32 `json:"pm25Standard,omitempty"`
+	Pm100Standard      uint32 `json:"pm100Standard,omitempty"`
+	Pm10Environmental  uint32 `json:"pm10Environmental,omitempty"`
+	Pm25Environmental  uint32 `json:"pm25Environmental,omitempty"`
+	Pm100Environmental uint32 `json:"pm100Environmental,omitempty"`
+	Particles03        uint32 `json:"particles03,omitempty"`
+	Particles05        uint32 `json:"particles05,omitempty"`
+	Particles10        uint32 `json:"particles10,omitempty"`
+	Particles25        uint32 `json:"particles25,omitempty"`
+	Particles50        uint32 `json:"particles50,omitempty"`
+	Particles100       uint32 `json:"particles100,omitempty"`
+	Co2                uint32 `json:"co2,omitempty"` // ppm
+	// derived from the latest reading rather than the 24 hour average the EPA uses
+	Aqi         int32  `json:"aqi,omitempty"`
+	AqiCategory string `json:"aqiCategory,omitempty"`
+}
+
+func NewAirQuality(metrics *generated.AirQualityMetrics) *AirQuality {
+	aq := &AirQuality{
+		Pm10Standard:       metrics.GetPm10Standard(),
+		Pm25Standard:       metrics.GetPm25Standard(),
+		Pm100Standard:      metrics.GetPm100Standard(),
+		Pm10Environmental:  metrics.GetPm10Environmental(),
+		Pm25Environmental:  metrics.GetPm25Environmental(),
+		Pm100Environmental: metrics.GetPm100Environmental(),
+		Particles03:        metrics.GetParticles_03Um(),
+		Particles05:        metrics.GetParticles_05Um(),
+		Particles10:        metrics.GetParticles_10Um(),
+		Particles25:        metrics.GetParticles_25Um(),
+		Particles50:        metrics.GetParticles_50Um(),
+		Particles100:       metrics.GetParticles_100Um(),
+		Co2:                metrics.GetCo2(),
+	}
+	// AQI is defined for the environmental (atmospheric) concentrations, and
+	// overall is the highest of the pollutants
+	hasPm25 := metrics.Pm25Environmental != nil || metrics.Pm25Standard != nil
+	if hasPm25 {
+		pm25 := aq.Pm25Environmental
+		if metrics.Pm25Environmental == nil {
+			pm25 = aq.Pm25Standard
+		}
+		aq.Aqi, aq.AqiCategory = aqi(pm25, pm25Breakpoints)
+	}
+	if metrics.Pm100Environmental != nil || metrics.Pm100Standard != nil {
+		pm100 := aq.Pm100Environmental
+		if metrics.Pm100Environmental == nil {
+			pm100 = aq.Pm100Standard
+		}
+		if index, category := aqi(pm100, pm100Breakpoints); !hasPm25 || index > aq.Aqi {
+			aq.Aqi, aq.AqiCategory = index, category
+		}
+	}
+	return aq
+}
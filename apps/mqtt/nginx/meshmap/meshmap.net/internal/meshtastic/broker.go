@@ -0,0 +1,149 @@
+package meshtastic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Broker is the configuration of an MQTT broker connection.
+type Broker struct {
+	Name               string `json:"name"`
+	URL                string `json:"url"`
+	Username           string `json:"username"`
+	Password           string `json:"password"`
+	CAFile             string `json:"caFile,omitempty"`   // PEM CA bundle, system roots if empty
+	CertFile           string `json:"certFile,omitempty"` // PEM client certificate for mTLS
+	KeyFile            string `json:"keyFile,omitempty"`  // PEM client key for mTLS
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// UsesTLS reports whether the broker URL requires a TLS connection.
+func (b *Broker) UsesTLS() bool {
+	scheme, _, _ := strings.Cut(b.URL, "://")
+	switch scheme {
+	case "ssl", "tls", "mqtts", "wss":
+		return true
+	}
+	return false
+}
+
+// TLSConfig builds the TLS configuration for the broker.
+func (b *Broker) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: b.InsecureSkipVerify,
+	}
+	if len(b.CAFile) > 0 {
+		pem, err := os.ReadFile(b.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", b.CAFile)
+		}
+	}
+	if len(b.CertFile) > 0 || len(b.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// BrokersFromEnv returns the brokers configured by MQTT_BROKER (comma
+// separated for several brokers sharing the other settings), MQTT_USERNAME,
+// MQTT_PASSWORD, MQTT_TLS_CA, MQTT_TLS_CERT, MQTT_TLS_KEY and MQTT_TLS_INSECURE,
+// defaulting to the public Meshtastic server.
+func BrokersFromEnv() []Broker {
+	urls := os.Getenv("MQTT_BROKER")
+	if urls == "" {
+		urls = "tcp://mqtt.meshtastic.org:1883"
+	}
+	username := os.Getenv("MQTT_USERNAME")
+	if username == "" {
+		username = "meshdev"
+	}
+	password := os.Getenv("MQTT_PASSWORD")
+	if password == "" {
+		password = "large4cats"
+	}
+	var brokers []Broker
+	for _, url := range strings.Split(urls, ",") {
+		url = strings.TrimSpace(url)
+		if len(url) == 0 {
+			continue
+		}
+		brokers = append(brokers, Broker{
+			Name:               url,
+			URL:                url,
+			Username:           username,
+			Password:           password,
+			CAFile:             os.Getenv("MQTT_TLS_CA"),
+			CertFile:           os.Getenv("MQTT_TLS_CERT"),
+			KeyFile:            os.Getenv("MQTT_TLS_KEY"),
+			InsecureSkipVerify: os.Getenv("MQTT_TLS_INSECURE") == "true",
+		})
+	}
+	return brokers
+}
+
+// LoadBrokers reads a JSON array of brokers.
+func LoadBrokers(path string) ([]Broker, error) {
+	var brokers []Broker
+	if err := LoadJSONFile(path, &brokers); err != nil {
+		return nil, err
+	}
+	for i := range brokers {
+		if len(brokers[i].URL) == 0 {
+			return nil, errors.New("broker without url")
+		}
+		if len(brokers[i].Name) == 0 {
+			brokers[i].Name = brokers[i].URL
+		}
+	}
+	return brokers, nil
+}
+
+// BrokerState is the connection state of a broker.
+type BrokerState struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Connected  bool   `json:"connected"`
+	Since      int64  `json:"since"` // time of the last state change
+	Reconnects uint32 `json:"reconnects"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+type brokerState struct {
+	mu        sync.Mutex
+	connected bool // ever
+	BrokerState
+}
+
+func (s *brokerState) update(connected bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if connected && s.connected && !s.Connected {
+		s.Reconnects++
+	}
+	s.connected = s.connected || connected
+	s.Connected = connected
+	s.Since = time.Now().Unix()
+	if err != nil {
+		s.LastError = err.Error()
+	}
+}
+
+func (s *brokerState) get() BrokerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.BrokerState
+}
@@ -0,0 +1,191 @@
+package meshtastic
+
+import (
+	"bufio"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ChatLimit     = 200 // messages kept per channel
+	ChatTextLimit = 256 // bytes
+)
+
+// ChatMessage is a broadcast text message on a public channel.
+type ChatMessage struct {
+	Id      uint32 `json:"id"`
+	From    uint32 `json:"from"`
+	Gateway string `json:"gateway,omitempty"`
+	Text    string `json:"text"`
+	Time    int64  `json:"time"`
+}
+
+// WordFilter masks listed words in text. Words match case-insensitively and
+// only as whole words.
+type WordFilter map[string]struct{}
+
+// LoadWordFilter reads a file with one word per line.
+// Blank lines and anything after a # are ignored.
+func LoadWordFilter(path string) (WordFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	words := make(WordFilter)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		words[strings.ToLower(line)] = struct{}{}
+	}
+	return words, s.Err()
+}
+
+// Mask replaces each filtered word in text with asterisks.
+func (words WordFilter) Mask(text string) string {
+	if len(words) == 0 {
+		return text
+	}
+	var b strings.Builder
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }
+	for len(text) > 0 {
+		end := strings.IndexFunc(text, func(r rune) bool { return !isWord(r) })
+		if end == 0 {
+			// copy the separator
+			_, size := utf8.DecodeRuneInString(text)
+			b.WriteString(text[:size])
+			text = text[size:]
+			continue
+		}
+		if end < 0 {
+			end = len(text)
+		}
+		word := text[:end]
+		if _, found := words[strings.ToLower(word)]; found {
+			word = strings.Repeat("*", utf8.RuneCountInString(word))
+		}
+		b.WriteString(word)
+		text = text[end:]
+	}
+	return b.String()
+}
+
+// WordFilterFile is a WordFilter file that is reloaded when it changes.
+type WordFilterFile struct {
+	Path    string
+	modTime time.Time
+}
+
+// Reload reads the file if it was modified since the last load, or if force is set.
+func (f *WordFilterFile) Reload(force bool) (WordFilter, bool, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !force && info.ModTime().Equal(f.modTime) {
+		return nil, false, nil
+	}
+	words, err := LoadWordFilter(f.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	f.modTime = info.ModTime()
+	return words, true, nil
+}
+
+// ChatArchive keeps the most recent broadcast text messages on opted-in
+// channels. Direct messages are never archived.
+type ChatArchive struct {
+	mu       sync.Mutex
+	channels map[string][]*ChatMessage
+	words    WordFilter
+	hidden   NodeSet
+}
+
+func NewChatArchive(channels ...string) *ChatArchive {
+	archive := &ChatArchive{channels: make(map[string][]*ChatMessage)}
+	for _, channel := range channels {
+		archive.channels[channel] = nil
+	}
+	return archive
+}
+
+// SetWordFilter replaces the word filter, applied when the feed is read.
+func (archive *ChatArchive) SetWordFilter(words WordFilter) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.words = words
+}
+
+// SetHidden replaces the moderation hide-list of nodes whose messages are left out of the feed.
+func (archive *ChatArchive) SetHidden(nodes NodeSet) {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	archive.hidden = nodes
+}
+
+// Add archives a text message packet, if it is a broadcast on an opted-in channel.
+func (archive *ChatArchive) Add(packet *Packet, text string) bool {
+	if !packet.IsBroadcast() {
+		return false
+	}
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	messages, found := archive.channels[packet.Channel]
+	if !found {
+		return false
+	}
+	if len(text) > ChatTextLimit {
+		text = text[:ChatTextLimit]
+	}
+	message := &ChatMessage{
+		Id:   packet.Id,
+		From: packet.From,
+		Text: strings.ToValidUTF8(text, ""),
+		Time: packet.RxTime(),
+	}
+	if packet.Reception != nil {
+		message.Gateway = packet.Reception.Gateway
+	}
+	// keep the feed oldest first when replaying older packets
+	i := len(messages)
+	for i > 0 && messages[i-1].Time > message.Time {
+		i--
+	}
+	messages = slices.Insert(messages, i, message)
+	if len(messages) > ChatLimit {
+		messages = messages[len(messages)-ChatLimit:]
+	}
+	archive.channels[packet.Channel] = messages
+	return true
+}
+
+// Feed returns the archived messages by channel, oldest first, with hidden
+// nodes left out and filtered words masked.
+func (archive *ChatArchive) Feed() map[string][]*ChatMessage {
+	archive.mu.Lock()
+	defer archive.mu.Unlock()
+	feed := make(map[string][]*ChatMessage, len(archive.channels))
+	for channel, messages := range archive.channels {
+		filtered := make([]*ChatMessage, 0, len(messages))
+		for _, message := range messages {
+			if _, found := archive.hidden[message.From]; found {
+				continue
+			}
+			masked := *message
+			masked.Text = archive.words.Mask(message.Text)
+			filtered = append(filtered, &masked)
+		}
+		feed[channel] = filtered
+	}
+	return feed
+}
@@ -0,0 +1,234 @@
+package meshtastic
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	CoTStale      = 10 * time.Minute
+	cotTimeFormat = "2006-01-02T15:04:05.000Z"
+	cotQueueSize  = 256
+	cotRetryDelay = 30 * time.Second
+	// CE and LE, meaning unknown
+	cotUnknownError = 9999999
+	cotAllChatRooms = "All Chat Rooms"
+)
+
+// Cursor-on-Target event, with the detail elements ATAK needs for PLI and GeoChat
+type cotEvent struct {
+	XMLName xml.Name  `xml:"event"`
+	Version string    `xml:"version,attr"`
+	Uid     string    `xml:"uid,attr"`
+	Type    string    `xml:"type,attr"`
+	How     string    `xml:"how,attr"`
+	Time    string    `xml:"time,attr"`
+	Start   string    `xml:"start,attr"`
+	Stale   string    `xml:"stale,attr"`
+	Point   cotPoint  `xml:"point"`
+	Detail  cotDetail `xml:"detail"`
+}
+
+type cotPoint struct {
+	Lat cotFloat `xml:"lat,attr"`
+	Lon cotFloat `xml:"lon,attr"`
+	Hae cotFloat `xml:"hae,attr"`
+	Ce  cotFloat `xml:"ce,attr"`
+	Le  cotFloat `xml:"le,attr"`
+}
+
+// cotFloat is a float attribute without an exponent, which some TAK servers reject
+type cotFloat float64
+
+func (f cotFloat) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	return xml.Attr{Name: name, Value: strconv.FormatFloat(float64(f), 'f', -1, 64)}, nil
+}
+
+type cotDetail struct {
+	Contact *cotContact `xml:"contact,omitempty"`
+	Group   *cotGroup   `xml:"__group,omitempty"`
+	Status  *cotStatus  `xml:"status,omitempty"`
+	Track   *cotTrack   `xml:"track,omitempty"`
+	Chat    *cotChat    `xml:"__chat,omitempty"`
+	Link    *cotLink    `xml:"link,omitempty"`
+	Remarks *cotRemarks `xml:"remarks,omitempty"`
+}
+
+type cotContact struct {
+	Callsign string `xml:"callsign,attr"`
+	Endpoint string `xml:"endpoint,attr,omitempty"`
+}
+
+type cotGroup struct {
+	Name string `xml:"name,attr"`
+	Role string `xml:"role,attr"`
+}
+
+type cotStatus struct {
+	Battery uint32 `xml:"battery,attr"`
+}
+
+type cotTrack struct {
+	Speed  uint32 `xml:"speed,attr"`
+	Course uint32 `xml:"course,attr"`
+}
+
+type cotChat struct {
+	Parent         string       `xml:"parent,attr"`
+	GroupOwner     string       `xml:"groupOwner,attr"`
+	Chatroom       string       `xml:"chatroom,attr"`
+	Id             string       `xml:"id,attr"`
+	SenderCallsign string       `xml:"senderCallsign,attr"`
+	ChatGroup      cotChatGroup `xml:"chatgrp"`
+}
+
+type cotChatGroup struct {
+	Uid0 string `xml:"uid0,attr"`
+	Uid1 string `xml:"uid1,attr"`
+	Id   string `xml:"id,attr"`
+}
+
+type cotLink struct {
+	Uid      string `xml:"uid,attr"`
+	Type     string `xml:"type,attr"`
+	Relation string `xml:"relation,attr"`
+}
+
+type cotRemarks struct {
+	Source string `xml:"source,attr"`
+	To     string `xml:"to,attr"`
+	Time   string `xml:"time,attr"`
+	Text   string `xml:",chardata"`
+}
+
+func newCoTEvent(uid, eventType, how string, now time.Time) *cotEvent {
+	return &cotEvent{
+		Version: "2.0",
+		Uid:     uid,
+		Type:    eventType,
+		How:     how,
+		Time:    now.UTC().Format(cotTimeFormat),
+		Start:   now.UTC().Format(cotTimeFormat),
+		Stale:   now.Add(CoTStale).UTC().Format(cotTimeFormat),
+		Point:   cotPoint{Hae: cotUnknownError, Ce: cotUnknownError, Le: cotUnknownError},
+	}
+}
+
+// PliCoT returns the position of an entity as a CoT event.
+func PliCoT(nodeNum uint32, entity *TakEntity) ([]byte, error) {
+	event := newCoTEvent(entity.Uid(nodeNum), "a-f-G-U-C", "m-g", time.Now())
+	event.Point.Lat = cotFloat(entity.Latitude) / 1e7
+	event.Point.Lon = cotFloat(entity.Longitude) / 1e7
+	event.Point.Hae = cotFloat(entity.Altitude)
+	event.Detail.Contact = &cotContact{Callsign: entity.Callsign, Endpoint: "*:-1:stcp"}
+	if len(entity.Team) > 0 || len(entity.Role) > 0 {
+		event.Detail.Group = &cotGroup{Name: entity.Team, Role: entity.Role}
+	}
+	if entity.Battery > 0 {
+		event.Detail.Status = &cotStatus{Battery: entity.Battery}
+	}
+	event.Detail.Track = &cotTrack{Speed: entity.Speed, Course: entity.Course}
+	return marshalCoT(event)
+}
+
+// ChatCoT returns a GeoChat message as a CoT event.
+func ChatCoT(nodeNum, packetId uint32, entity *TakEntity, chat *TakChat) ([]byte, error) {
+	senderUid := entity.Uid(nodeNum)
+	room, roomUid := cotAllChatRooms, cotAllChatRooms
+	if len(chat.To) > 0 && chat.To != cotAllChatRooms {
+		room, roomUid = chat.ToCallsign, chat.To
+	}
+	now := time.Now()
+	event := newCoTEvent(fmt.Sprintf("GeoChat.%v.%v.%v", senderUid, roomUid, packetId), "b-t-f", "h-g-i-g-o", now)
+	event.Detail.Chat = &cotChat{
+		Parent:         "RootContactGroup",
+		GroupOwner:     "false",
+		Chatroom:       room,
+		Id:             roomUid,
+		SenderCallsign: chat.Callsign,
+		ChatGroup:      cotChatGroup{Uid0: senderUid, Uid1: roomUid, Id: roomUid},
+	}
+	event.Detail.Link = &cotLink{Uid: senderUid, Type: "a-f-G-U-C", Relation: "p-p"}
+	event.Detail.Remarks = &cotRemarks{
+		Source: "BAO.F.ATAK." + senderUid,
+		To:     roomUid,
+		Time:   now.UTC().Format(cotTimeFormat),
+		Text:   chat.Message,
+	}
+	return marshalCoT(event)
+}
+
+func marshalCoT(event *cotEvent) ([]byte, error) {
+	b, err := xml.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// CoTSender sends CoT events to a TAK server in the background, over TCP or
+// UDP, reconnecting as needed. Events are dropped while the queue is full.
+type CoTSender struct {
+	network string
+	address string
+	queue   chan []byte
+}
+
+// NewCoTSender starts a sender to a tcp://host:port or udp://host:port address.
+func NewCoTSender(address string) (*CoTSender, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "tcp" && u.Scheme != "udp") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid TAK server address %q", address)
+	}
+	s := &CoTSender{
+		network: u.Scheme,
+		address: u.Host,
+		queue:   make(chan []byte, cotQueueSize),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send queues an event.
+func (s *CoTSender) Send(event []byte) bool {
+	select {
+	case s.queue <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *CoTSender) run() {
+	var conn net.Conn
+	var retryAt time.Time
+	for event := range s.queue {
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			var err error
+			conn, err = net.DialTimeout(s.network, s.address, 10*time.Second)
+			if err != nil {
+				log.Printf("[warn] connect to TAK server %v: %v", s.address, err)
+				conn = nil
+				retryAt = time.Now().Add(cotRetryDelay)
+				continue
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(event); err != nil {
+			log.Printf("[warn] send to TAK server %v: %v", s.address, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
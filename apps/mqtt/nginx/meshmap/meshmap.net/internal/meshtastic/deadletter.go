@@ -0,0 +1,105 @@
+package meshtastic
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a raw ServiceEnvelope that could not be handled.
+type DeadLetter struct {
+	Time    int64  `json:"time"`
+	Topic   string `json:"topic"`
+	Reason  string `json:"reason"`
+	Payload []byte `json:"payload"`
+}
+
+// DeadLetterWriter appends dead letters to a JSON lines file. Once the file
+// would grow past maxSize bytes, it is moved to path.1, replacing the older one.
+type DeadLetterWriter struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64 // 0 for no limit
+	f       *os.File
+	size    int64
+}
+
+func OpenDeadLetters(path string, maxSize int64) (*DeadLetterWriter, error) {
+	w := &DeadLetterWriter{path: path, maxSize: maxSize}
+	return w, w.open()
+}
+
+func (w *DeadLetterWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *DeadLetterWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *DeadLetterWriter) Write(topic, reason string, payload []byte) error {
+	line, err := json.Marshal(&DeadLetter{
+		Time:    time.Now().Unix(),
+		Topic:   topic,
+		Reason:  reason,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *DeadLetterWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// ReadDeadLetters calls fn for each dead letter in the file at path.
+func ReadDeadLetters(path string, fn func(letter *DeadLetter)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(s.Bytes(), &letter); err != nil {
+			return err
+		}
+		fn(&letter)
+	}
+	return s.Err()
+}
@@ -0,0 +1,117 @@
+package meshtastic
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReceptionLimit bounds the receptions queued per packet until it is decoded.
+const ReceptionLimit = 32
+
+// Reception is a single copy of a packet as uplinked by a gateway.
+type Reception struct {
+	Gateway  string  `json:"gateway"`
+	Topic    string  `json:"topic"`
+	Root     string  `json:"root"`
+	Region   string  `json:"region"`
+	Channel  string  `json:"channel,omitempty"` // empty for map reports
+	RxSnr    float32 `json:"rxSnr,omitempty"`
+	RxRssi   int32   `json:"rxRssi,omitempty"`
+	HopsAway int32   `json:"hopsAway"` // -1 if the sender did not report HopStart
+	RxTime   int64   `json:"rxTime"`
+}
+
+type packetKey struct {
+	from, id uint32
+}
+
+type cacheEntry struct {
+	packet  *Packet      // nil until the first copy is decoded
+	pending []*Reception // duplicates received before that
+	created time.Time
+}
+
+// PacketCache deduplicates packets heard by several gateways, keyed on the
+// sender and packet ID, while passing on every reception.
+type PacketCache struct {
+	ttl        time.Duration
+	mu         sync.Mutex
+	entries    map[packetKey]*cacheEntry
+	lastSweep  time.Time
+	unique     atomic.Uint64
+	duplicates atomic.Uint64
+}
+
+func NewPacketCache(ttl time.Duration) *PacketCache {
+	return &PacketCache{
+		ttl:       ttl,
+		entries:   make(map[packetKey]*cacheEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Add records a reception of packet id from a node and reports whether it is
+// the first one. A first one is only recorded if admit, when set, accepts it.
+// For duplicates, the decoded packet is returned if known, otherwise the
+// reception is queued until SetPacket.
+func (c *PacketCache) Add(from, id uint32, rx *Reception, admit func() bool) (bool, *Packet) {
+	now := time.Now()
+	key := packetKey{from, id}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, entry := range c.entries {
+			if now.Sub(entry.created) > c.ttl {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	entry := c.entries[key]
+	if entry == nil || now.Sub(entry.created) > c.ttl {
+		if admit != nil && !admit() {
+			// not seen, so a later copy gets another chance
+			return false, nil
+		}
+		c.entries[key] = &cacheEntry{created: now}
+		c.unique.Add(1)
+		return true, nil
+	}
+	c.duplicates.Add(1)
+	if entry.packet == nil && len(entry.pending) < ReceptionLimit {
+		entry.pending = append(entry.pending, rx)
+	}
+	return false, entry.packet
+}
+
+// SetPacket stores the decoded packet for later duplicates of it, and returns
+// the duplicates received while it was being decoded.
+func (c *PacketCache) SetPacket(packet *Packet) []*Reception {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[packetKey{packet.From, packet.Id}]
+	if entry == nil {
+		return nil
+	}
+	entry.packet = packet
+	pending := entry.pending
+	entry.pending = nil
+	return pending
+}
+
+// Packet returns the decoded packet id from a node, if it is still cached.
+func (c *PacketCache) Packet(from, id uint32) *Packet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[packetKey{from, id}]
+	if entry == nil || time.Since(entry.created) > c.ttl {
+		return nil
+	}
+	return entry.packet
+}
+
+// Stats returns the number of unique and duplicate packets seen.
+func (c *PacketCache) Stats() (unique, duplicates uint64) {
+	return c.unique.Load(), c.duplicates.Load()
+}
@@ -0,0 +1,124 @@
+package meshtastic
+
+import (
+	"time"
+
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+)
+
+// DeliveryStats counts the routing ACKs and NAKs for packets a node sent.
+type DeliveryStats struct {
+	Acks    uint32            `json:"acks"`
+	Naks    uint32            `json:"naks"`
+	Reasons map[string]uint32 `json:"reasons,omitempty"` // NAKs by Routing_Error
+	// ACKs and NAKs tied back to their request
+	Matched uint32  `json:"matched,omitempty"`
+	Latency float32 `json:"latency,omitempty"` // average seconds from request to ACK or NAK
+	Updated int64   `json:"updated"`
+}
+
+func (stats *DeliveryStats) add(reason generated.Routing_Error, latency int64, matched bool, updated int64) {
+	if reason == generated.Routing_NONE {
+		stats.Acks++
+	} else {
+		stats.Naks++
+		if stats.Reasons == nil {
+			stats.Reasons = make(map[string]uint32)
+		}
+		stats.Reasons[reason.String()]++
+	}
+	if matched {
+		stats.Latency = (stats.Latency*float32(stats.Matched) + float32(latency)) / float32(stats.Matched+1)
+		stats.Matched++
+	}
+	stats.Updated = max(stats.Updated, updated)
+}
+
+type deliveryPair struct {
+	from, to uint32
+}
+
+// DeliveryPair is DeliveryStats for packets From one node that To answered.
+type DeliveryPair struct {
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+	*DeliveryStats
+}
+
+// DeliveryLog builds delivery statistics from routing ACKs and NAKs, per
+// sending node and per pair of sending and answering nodes.
+type DeliveryLog struct {
+	nodes map[uint32]*DeliveryStats
+	pairs map[deliveryPair]*DeliveryStats
+}
+
+func NewDeliveryLog() *DeliveryLog {
+	return &DeliveryLog{
+		nodes: make(map[uint32]*DeliveryStats),
+		pairs: make(map[deliveryPair]*DeliveryStats),
+	}
+}
+
+// Add records a routing ACK or NAK, a packet from the answering node to the
+// sender of the request.
+func (d *DeliveryLog) Add(packet *Packet, reason generated.Routing_Error) {
+	sender, responder := packet.To, packet.From
+	var latency int64
+	matched := packet.Request != nil && packet.Request.Reception != nil && packet.Reception != nil
+	if matched {
+		latency = max(packet.Reception.RxTime-packet.Request.Reception.RxTime, 0)
+	}
+	stats := d.nodes[sender]
+	if stats == nil {
+		stats = new(DeliveryStats)
+		d.nodes[sender] = stats
+	}
+	stats.add(reason, latency, matched, packet.RxTime())
+	key := deliveryPair{sender, responder}
+	stats = d.pairs[key]
+	if stats == nil {
+		stats = new(DeliveryStats)
+		d.pairs[key] = stats
+	}
+	stats.add(reason, latency, matched, packet.RxTime())
+}
+
+// Prune removes statistics not updated within ttl.
+func (d *DeliveryLog) Prune(ttl int64) {
+	now := time.Now().Unix()
+	for nodeNum, stats := range d.nodes {
+		if stats.Updated+ttl < now {
+			delete(d.nodes, nodeNum)
+		}
+	}
+	for key, stats := range d.pairs {
+		if stats.Updated+ttl < now {
+			delete(d.pairs, key)
+		}
+	}
+}
+
+// DeliveryReport is the content of a DeliveryLog, with the NAKs of all nodes by reason.
+type DeliveryReport struct {
+	Reasons map[string]uint32         `json:"reasons"`
+	Nodes   map[uint32]*DeliveryStats `json:"nodes"`
+	Pairs   []DeliveryPair            `json:"pairs"`
+}
+
+func (d *DeliveryLog) Report() *DeliveryReport {
+	report := &DeliveryReport{
+		Reasons: make(map[string]uint32),
+		Nodes:   make(map[uint32]*DeliveryStats, len(d.nodes)),
+		Pairs:   make([]DeliveryPair, 0, len(d.pairs)),
+	}
+	for nodeNum, stats := range d.nodes {
+		report.Nodes[nodeNum] = stats
+		for reason, count := range stats.Reasons {
+			report.Reasons[reason] += count
+		}
+	}
+	for key, stats := range d.pairs {
+		report.Pairs = append(report.Pairs, DeliveryPair{From: key.from, To: key.to, DeliveryStats: stats})
+	}
+	return report
+}
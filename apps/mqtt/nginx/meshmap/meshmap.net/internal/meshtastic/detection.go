@@ -0,0 +1,76 @@
+package meshtastic
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+const AlertLimit = 500
+
+// DetectionEvent is a detection sensor trigger, with where the sensor was.
+type DetectionEvent struct {
+	From      uint32 `json:"from"`
+	Text      string `json:"text"`
+	Channel   string `json:"channel,omitempty"`
+	Latitude  int32  `json:"latitude,omitempty"`
+	Longitude int32  `json:"longitude,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+// AlertFeed keeps the most recent detection events, oldest first. Repeats of
+// an event from the same sensor within Debounce are dropped.
+type AlertFeed struct {
+	Debounce time.Duration
+	events   []*DetectionEvent
+	last     map[uint32]*DetectionEvent // by sensor
+}
+
+func NewAlertFeed(debounce time.Duration) *AlertFeed {
+	return &AlertFeed{
+		Debounce: debounce,
+		events:   []*DetectionEvent{},
+		last:     make(map[uint32]*DetectionEvent),
+	}
+}
+
+// Add records a detection event unless it is a repeat within Debounce.
+// Events are kept in time order, so replayed events don't hold back Prune.
+func (feed *AlertFeed) Add(event *DetectionEvent) bool {
+	event.Text = strings.ToValidUTF8(strings.TrimSpace(event.Text), "")
+	last := feed.last[event.From]
+	if last != nil && last.Text == event.Text &&
+		time.Duration(max(event.Time-last.Time, last.Time-event.Time))*time.Second < feed.Debounce {
+		return false
+	}
+	if last == nil || event.Time >= last.Time {
+		feed.last[event.From] = event
+	}
+	i := len(feed.events)
+	for i > 0 && feed.events[i-1].Time > event.Time {
+		i--
+	}
+	feed.events = slices.Insert(feed.events, i, event)
+	if len(feed.events) > AlertLimit {
+		feed.events = feed.events[len(feed.events)-AlertLimit:]
+	}
+	return true
+}
+
+// Prune removes events older than ttl.
+func (feed *AlertFeed) Prune(ttl int64) {
+	now := time.Now().Unix()
+	for len(feed.events) > 0 && feed.events[0].Time+ttl < now {
+		feed.events = feed.events[1:]
+	}
+	for nodeNum, last := range feed.last {
+		if last.Time+ttl < now {
+			delete(feed.last, nodeNum)
+		}
+	}
+}
+
+// Events returns the events, oldest first.
+func (feed *AlertFeed) Events() []*DetectionEvent {
+	return feed.events
+}
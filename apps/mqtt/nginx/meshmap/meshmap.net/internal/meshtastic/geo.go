@@ -0,0 +1,17 @@
+package meshtastic
+
+import (
+	"math"
+)
+
+const earthRadius = 6371008.8 // mean, in m
+
+// Distance returns the great-circle distance in m between two positions in degrees * 1e-7.
+func Distance(latitude1, longitude1, latitude2, longitude2 int32) float64 {
+	toRadians := func(i int32) float64 { return float64(i) / 1e7 * math.Pi / 180 }
+	lat1, lat2 := toRadians(latitude1), toRadians(latitude2)
+	dLat := lat2 - lat1
+	dLon := toRadians(longitude2) - toRadians(longitude1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(min(a, 1)))
+}
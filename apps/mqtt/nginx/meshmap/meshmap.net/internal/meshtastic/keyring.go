@@ -0,0 +1,186 @@
+package meshtastic
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// ExpandKey converts a channel PSK as stored in the channel settings to the
+// AES key used on air, following the firmware rules: an empty key means no
+// encryption, a 1-byte key is shorthand for the default key with its last byte
+// offset by index-1, and short keys are zero padded to AES-128 or AES-256.
+func ExpandKey(psk []byte) ([]byte, error) {
+	switch {
+	case len(psk) == 0:
+		return nil, nil
+	case len(psk) == 1:
+		index := psk[0]
+		if index == 0 {
+			return nil, nil
+		}
+		key := make([]byte, len(DefaultKey))
+		copy(key, DefaultKey)
+		key[len(key)-1] += index - 1
+		return key, nil
+	case len(psk) <= 16:
+		key := make([]byte, 16)
+		copy(key, psk)
+		return key, nil
+	case len(psk) <= 32:
+		key := make([]byte, 32)
+		copy(key, psk)
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid key length %v", len(psk))
+}
+
+// ParseKey decodes a base64 channel PSK and expands it with ExpandKey.
+func ParseKey(s string) ([]byte, error) {
+	psk, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ExpandKey(psk)
+}
+
+// ChannelHash returns the hash the firmware puts in MeshPacket.Channel of
+// encrypted packets: the XOR of the channel name bytes and the key bytes.
+func ChannelHash(channel string, key []byte) uint32 {
+	var hash byte
+	for _, b := range []byte(channel) {
+		hash ^= b
+	}
+	for _, b := range key {
+		hash ^= b
+	}
+	return uint32(hash)
+}
+
+// noChannelHash never matches a packet, as channel hashes are a single byte.
+const noChannelHash = 1 << 8
+
+type keyringEntry struct {
+	channel string
+	hash    uint32       // ChannelHash, or noChannelHash if unknown
+	block   cipher.Block // nil if the channel is not encrypted
+}
+
+// Keyring holds the PSKs of the channels to decrypt, in the order they are tried.
+type Keyring struct {
+	entries []keyringEntry
+}
+
+// Add adds a channel with an expanded key. A nil key marks an unencrypted
+// channel. An empty channel name makes the key a candidate for any channel.
+func (k *Keyring) Add(channel string, key []byte) {
+	var block cipher.Block
+	if len(key) > 0 {
+		block = NewBlockCipher(key)
+	}
+	k.entries = append(k.entries, keyringEntry{channel, ChannelHash(channel, key), block})
+}
+
+// AddBlockCipher adds a channel with an already constructed block cipher. Its
+// channel hash is unknown, so it is only tried by name or as a last resort.
+func (k *Keyring) AddBlockCipher(channel string, block cipher.Block) {
+	k.entries = append(k.entries, keyringEntry{channel, noChannelHash, block})
+}
+
+// Len returns the number of keys in the keyring.
+func (k *Keyring) Len() int {
+	return len(k.entries)
+}
+
+// Parse adds keys from "channel=base64psk" entries.
+func (k *Keyring) Parse(entries ...string) error {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		channel, psk, found := strings.Cut(entry, "=")
+		if !found {
+			return fmt.Errorf("invalid keyring entry %q", entry)
+		}
+		// base64 padding is also '=', so cut only once and keep the rest
+		key, err := ParseKey(strings.TrimSpace(psk))
+		if err != nil {
+			return fmt.Errorf("invalid key for channel %q: %w", channel, err)
+		}
+		k.Add(strings.TrimSpace(channel), key)
+	}
+	return nil
+}
+
+// LoadFile adds keys from a file with one "channel=base64psk" entry per line.
+func (k *Keyring) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if err := k.Parse(s.Text()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// Decrypt tries the keys for channel first, then the named channels whose
+// ChannelHash is hash, then the remaining keys in order, and returns the Data
+// and the name of the channel whose key decoded it.
+func (k *Keyring) Decrypt(channel string, hash, packetId, from uint32, encrypted []byte) (*generated.Data, string, bool) {
+	rank := func(entry keyringEntry) int {
+		switch {
+		case entry.channel == channel:
+			return 0
+		case len(entry.channel) > 0 && entry.hash == hash:
+			return 1
+		}
+		return 2
+	}
+	for pass := range 3 {
+		for _, entry := range k.entries {
+			if rank(entry) != pass {
+				continue
+			}
+			if data := entry.decrypt(packetId, from, encrypted); data != nil {
+				if len(entry.channel) > 0 {
+					channel = entry.channel
+				}
+				return data, channel, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+func (entry keyringEntry) decrypt(packetId, from uint32, encrypted []byte) *generated.Data {
+	decrypted := encrypted
+	if entry.block != nil {
+		nonce := make([]byte, 16)
+		binary.LittleEndian.PutUint32(nonce[0:], packetId)
+		binary.LittleEndian.PutUint32(nonce[8:], from)
+		decrypted = make([]byte, len(encrypted))
+		cipher.NewCTR(entry.block, nonce).XORKeyStream(decrypted, encrypted)
+	}
+	data := new(generated.Data)
+	if err := proto.Unmarshal(decrypted, data); err != nil {
+		return nil
+	}
+	// a wrong key usually fails to parse, but the firmware also rejects portnum 0
+	if data.GetPortnum() == generated.PortNum_UNKNOWN_APP {
+		return nil
+	}
+	return data
+}
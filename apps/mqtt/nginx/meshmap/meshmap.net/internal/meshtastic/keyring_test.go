@@ -0,0 +1,138 @@
+package meshtastic
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExpandKey(t *testing.T) {
+	tests := []struct {
+		name string
+		psk  []byte
+		key  string // hex, empty for no encryption
+	}{
+		{"empty", nil, ""},
+		{"no encryption", []byte{0x00}, ""},
+		{"default", []byte{0x01}, "d4f1bb3a20290759f0bcffabcf4e6901"},
+		{"simple 2", []byte{0x02}, "d4f1bb3a20290759f0bcffabcf4e6902"},
+		{"simple 5", []byte{0x05}, "d4f1bb3a20290759f0bcffabcf4e6905"},
+		{"simple 10", []byte{0x0a}, "d4f1bb3a20290759f0bcffabcf4e690a"},
+		{"short", []byte{0xaa, 0xbb}, "aabb0000000000000000000000000000"},
+		{"AES-128", bytes.Repeat([]byte{0x11}, 16), "11111111111111111111111111111111"},
+		{"padded AES-256", bytes.Repeat([]byte{0x22}, 17), "2222222222222222222222222222222222000000000000000000000000000000"},
+		{"AES-256", bytes.Repeat([]byte{0x33}, 32), "3333333333333333333333333333333333333333333333333333333333333333"},
+	}
+	for _, test := range tests {
+		key, err := ExpandKey(test.psk)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if got := hex.EncodeToString(key); got != test.key {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.key)
+		}
+	}
+	if _, err := ExpandKey(make([]byte, 33)); err == nil {
+		t.Error("33-byte key: no error")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("AQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, DefaultKey) {
+		t.Errorf("AQ== expanded to %x, want the default key %x", key, DefaultKey)
+	}
+	if _, err := ParseKey("not base64"); err == nil {
+		t.Error("invalid base64: no error")
+	}
+}
+
+// the hashes the firmware shows for the default key on the modem presets
+func TestChannelHash(t *testing.T) {
+	for channel, hash := range map[string]uint32{
+		"LongFast":   8,
+		"MediumFast": 31,
+		"ShortFast":  112,
+	} {
+		if got := ChannelHash(channel, DefaultKey); got != hash {
+			t.Errorf("%v: got %v, want %v", channel, got, hash)
+		}
+	}
+}
+
+// encryptData encrypts data the way the firmware does for channel packets.
+func encryptData(t *testing.T, key []byte, packetId, from uint32, data *generated.Data) []byte {
+	t.Helper()
+	plaintext, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, 16)
+	binary.LittleEndian.PutUint32(nonce[0:], packetId)
+	binary.LittleEndian.PutUint32(nonce[8:], from)
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCTR(NewBlockCipher(key), nonce).XORKeyStream(encrypted, plaintext)
+	return encrypted
+}
+
+func TestKeyringDecrypt(t *testing.T) {
+	staffKey := bytes.Repeat([]byte{0x5a}, 32)
+	var keyring Keyring
+	if err := keyring.Parse(
+		"LongFast=AQ==",
+		"# the ghost channel shares the staff key",
+		"ghost=WlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlo=",
+		"staff=WlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlo=",
+		"open=AA==",
+	); err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Len() != 4 {
+		t.Fatalf("got %v keys, want 4", keyring.Len())
+	}
+	const packetId, from = 0x1234abcd, 0xdeadbeef
+	data := &generated.Data{Portnum: generated.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hello")}
+	plain, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		channel   string
+		hash      uint32
+		encrypted []byte
+		expected  string
+	}{
+		{"by name", "staff", 0, encryptData(t, staffKey, packetId, from, data), "staff"},
+		{"by hash", "", ChannelHash("staff", staffKey), encryptData(t, staffKey, packetId, from, data), "staff"},
+		{"first key that works", "", 0, encryptData(t, staffKey, packetId, from, data), "ghost"},
+		{"default key", "LongFast", 8, encryptData(t, DefaultKey, packetId, from, data), "LongFast"},
+		{"unencrypted", "open", 0, plain, "open"},
+	}
+	for _, test := range tests {
+		decoded, channel, ok := keyring.Decrypt(test.channel, test.hash, packetId, from, test.encrypted)
+		if !ok {
+			t.Errorf("%v: not decrypted", test.name)
+			continue
+		}
+		if channel != test.expected {
+			t.Errorf("%v: decoded on %q, want %q", test.name, channel, test.expected)
+		}
+		if !proto.Equal(decoded, data) {
+			t.Errorf("%v: got %v, want %v", test.name, decoded, data)
+		}
+	}
+	unknown := encryptData(t, bytes.Repeat([]byte{0x77}, 16), packetId, from, data)
+	if _, _, ok := keyring.Decrypt("", 0, packetId, from, unknown); ok {
+		t.Error("decrypted with a key not in the keyring")
+	}
+}
@@ -0,0 +1,104 @@
+package meshtastic
+
+import (
+	"log"
+)
+
+const KeyHistoryLimit = 10
+
+// KeyRecord is a public key seen for a node.
+type KeyRecord struct {
+	Key       string `json:"key"`
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen"`
+	Count     uint32 `json:"count"`
+}
+
+// KeyPin is the trust-on-first-use public key of a node, along with every key seen for it.
+type KeyPin struct {
+	Pinned       string       `json:"pinned"`
+	History      []*KeyRecord `json:"history"`
+	Conflicts    uint32       `json:"conflicts,omitempty"`
+	LastConflict int64        `json:"lastConflict,omitempty"`
+}
+
+func (pin *KeyPin) lastSeen(key string) int64 {
+	for _, record := range pin.History {
+		if record.Key == key {
+			return record.LastSeen
+		}
+	}
+	return 0
+}
+
+func (pin *KeyPin) record(key string, now int64) {
+	for _, record := range pin.History {
+		if record.Key == key {
+			record.LastSeen = now
+			record.Count++
+			return
+		}
+	}
+	pin.History = append(pin.History, &KeyRecord{
+		Key:       key,
+		FirstSeen: now,
+		LastSeen:  now,
+		Count:     1,
+	})
+	for len(pin.History) > KeyHistoryLimit {
+		// never forget the pinned key
+		toDelete := -1
+		for i, record := range pin.History {
+			if record.Key == pin.Pinned {
+				continue
+			}
+			if toDelete < 0 || record.LastSeen < pin.History[toDelete].LastSeen {
+				toDelete = i
+			}
+		}
+		pin.History = append(pin.History[:toDelete], pin.History[toDelete+1:]...)
+	}
+}
+
+// KeyDB maps node numbers to their pinned public keys.
+// Unlike NodeDB it is never pruned, so pins outlive the nodes on the map.
+type KeyDB map[uint32]*KeyPin
+
+// Check records key as seen for nodeNum at now and reports whether it matches
+// the pinned key. The first key seen for a node is pinned. A node gets a new
+// key on a factory reset, so a pinned key unseen for pinTtl s is replaced.
+func (db KeyDB) Check(nodeNum uint32, key string, now, pinTtl int64) bool {
+	pin := db[nodeNum]
+	if pin == nil {
+		pin = &KeyPin{Pinned: key}
+		db[nodeNum] = pin
+	}
+	pin.record(key, now)
+	if pin.Pinned == key {
+		return true
+	}
+	if lastSeen := pin.lastSeen(pin.Pinned); pinTtl > 0 && lastSeen+pinTtl < now {
+		log.Printf("[info] node %v pinned to public key %v, %v unseen since %v", nodeNum, key, pin.Pinned, lastSeen)
+		pin.Pinned = key
+		return true
+	}
+	pin.Conflicts++
+	pin.LastConflict = now
+	return false
+}
+
+// Pinned returns the pinned public key of nodeNum, if any.
+func (db KeyDB) Pinned(nodeNum uint32) string {
+	if pin := db[nodeNum]; pin != nil {
+		return pin.Pinned
+	}
+	return ""
+}
+
+func (db *KeyDB) LoadFile(path string) error {
+	return LoadJSONFile(path, db)
+}
+
+func (db KeyDB) WriteFile(path string) error {
+	return WriteJSONFile(path, db)
+}
@@ -0,0 +1,34 @@
+package meshtastic
+
+import (
+	"testing"
+)
+
+func TestKeyDBCheck(t *testing.T) {
+	const nodeNum, day = 0xdeadbeef, 24 * 60 * 60
+	db := make(KeyDB)
+	if !db.Check(nodeNum, "0xaa", 0, day) {
+		t.Fatal("first key not pinned")
+	}
+	if db.Check(nodeNum, "0xbb", day/2, day) {
+		t.Error("other key accepted while the pinned key is current")
+	}
+	if !db.Check(nodeNum, "0xaa", day/2, day) {
+		t.Error("pinned key rejected")
+	}
+	if db.Check(nodeNum, "0xbb", day, 0) {
+		t.Error("other key accepted without expiry")
+	}
+	if !db.Check(nodeNum, "0xbb", 2*day, day) {
+		t.Error("other key rejected after the pinned key went unseen")
+	}
+	if pinned := db.Pinned(nodeNum); pinned != "0xbb" {
+		t.Errorf("pinned %v, want 0xbb", pinned)
+	}
+	if db.Check(nodeNum, "0xaa", 2*day, day) {
+		t.Error("replaced key accepted")
+	}
+	if pin := db[nodeNum]; pin.Conflicts != 3 || pin.LastConflict != 2*day {
+		t.Errorf("got %v conflicts, last at %v, want 3 at %v", pin.Conflicts, pin.LastConflict, 2*day)
+	}
+}
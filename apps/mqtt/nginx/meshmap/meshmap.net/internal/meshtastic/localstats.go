@@ -0,0 +1,132 @@
+package meshtastic
+
+// LocalStatsDelta is how much the LocalStats counters of a node increased
+// between two reports.
+type LocalStatsDelta struct {
+	Seconds         uint32 `json:"seconds"`
+	PacketsTx       uint32 `json:"packetsTx"`
+	PacketsRx       uint32 `json:"packetsRx"`
+	PacketsRxBad    uint32 `json:"packetsRxBad"`
+	RxDupe          uint32 `json:"rxDupe"`
+	TxRelay         uint32 `json:"txRelay"`
+	TxRelayCanceled uint32 `json:"txRelayCanceled"`
+}
+
+// LocalStats is a node's view of the mesh. The counters are since the node booted.
+type LocalStats struct {
+	Uptime          uint32           `json:"uptime"`
+	ChUtil          float32          `json:"chUtil"`
+	AirUtilTx       float32          `json:"airUtilTx"`
+	PacketsTx       uint32           `json:"packetsTx"`
+	PacketsRx       uint32           `json:"packetsRx"`
+	PacketsRxBad    uint32           `json:"packetsRxBad"`
+	RxDupe          uint32           `json:"rxDupe"`
+	TxRelay         uint32           `json:"txRelay"`
+	TxRelayCanceled uint32           `json:"txRelayCanceled"`
+	OnlineNodes     uint32           `json:"onlineNodes"`
+	TotalNodes      uint32           `json:"totalNodes"`
+	Delta           *LocalStatsDelta `json:"delta,omitempty"` // since the previous report
+}
+
+// deltaSince returns the counter increases since prev, if any. If the node
+// rebooted, the counters started over, so the increases are the counters themselves.
+func (stats *LocalStats) deltaSince(prev *LocalStats) *LocalStatsDelta {
+	if prev == nil {
+		return nil
+	}
+	if stats.Uptime < prev.Uptime {
+		return &LocalStatsDelta{
+			Seconds:         stats.Uptime,
+			PacketsTx:       stats.PacketsTx,
+			PacketsRx:       stats.PacketsRx,
+			PacketsRxBad:    stats.PacketsRxBad,
+			RxDupe:          stats.RxDupe,
+			TxRelay:         stats.TxRelay,
+			TxRelayCanceled: stats.TxRelayCanceled,
+		}
+	}
+	if stats.PacketsTx < prev.PacketsTx ||
+		stats.PacketsRx < prev.PacketsRx ||
+		stats.PacketsRxBad < prev.PacketsRxBad ||
+		stats.RxDupe < prev.RxDupe ||
+		stats.TxRelay < prev.TxRelay ||
+		stats.TxRelayCanceled < prev.TxRelayCanceled {
+		// a counter went backwards without a reboot, nothing to compare against
+		return nil
+	}
+	return &LocalStatsDelta{
+		Seconds:         stats.Uptime - prev.Uptime,
+		PacketsTx:       stats.PacketsTx - prev.PacketsTx,
+		PacketsRx:       stats.PacketsRx - prev.PacketsRx,
+		PacketsRxBad:    stats.PacketsRxBad - prev.PacketsRxBad,
+		RxDupe:          stats.RxDupe - prev.RxDupe,
+		TxRelay:         stats.TxRelay - prev.TxRelay,
+		TxRelayCanceled: stats.TxRelayCanceled - prev.TxRelayCanceled,
+	}
+}
+
+// MeshHealth summarizes the LocalStats of the nodes on part of the mesh.
+// Counters are sums of the increases between the nodes' last two reports.
+type MeshHealth struct {
+	Nodes           int     `json:"nodes"`
+	ChUtil          float32 `json:"chUtil"`    // average %
+	AirUtilTx       float32 `json:"airUtilTx"` // average duty cycle %
+	PacketsTx       uint32  `json:"packetsTx"`
+	PacketsRx       uint32  `json:"packetsRx"`
+	PacketsRxBad    uint32  `json:"packetsRxBad"`
+	RxDupe          uint32  `json:"rxDupe"`
+	TxRelay         uint32  `json:"txRelay"`
+	TxRelayCanceled uint32  `json:"txRelayCanceled"`
+	BadRate         float32 `json:"badRate"` // share of received packets that were corrupt, mostly collisions
+	DupeRate        float32 `json:"dupeRate"`
+	Updated         int64   `json:"updated"`
+}
+
+func (health *MeshHealth) add(stats *LocalStats, updated int64) {
+	health.ChUtil = (health.ChUtil*float32(health.Nodes) + stats.ChUtil) / float32(health.Nodes+1)
+	health.AirUtilTx = (health.AirUtilTx*float32(health.Nodes) + stats.AirUtilTx) / float32(health.Nodes+1)
+	health.Nodes++
+	if delta := stats.Delta; delta != nil {
+		health.PacketsTx += delta.PacketsTx
+		health.PacketsRx += delta.PacketsRx
+		health.PacketsRxBad += delta.PacketsRxBad
+		health.RxDupe += delta.RxDupe
+		health.TxRelay += delta.TxRelay
+		health.TxRelayCanceled += delta.TxRelayCanceled
+	}
+	if received := health.PacketsRx + health.PacketsRxBad; received > 0 {
+		health.BadRate = float32(health.PacketsRxBad) / float32(received)
+	}
+	if health.PacketsRx > 0 {
+		health.DupeRate = float32(health.RxDupe) / float32(health.PacketsRx)
+	}
+	health.Updated = max(health.Updated, updated)
+}
+
+// MeshHealthSummary is MeshHealth by MQTT region and by topic (without the gateway).
+type MeshHealthSummary struct {
+	Regions map[string]*MeshHealth `json:"regions"`
+	Topics  map[string]*MeshHealth `json:"topics"`
+}
+
+func (db NodeDB) GetMeshHealth() *MeshHealthSummary {
+	summary := &MeshHealthSummary{
+		Regions: make(map[string]*MeshHealth),
+		Topics:  make(map[string]*MeshHealth),
+	}
+	for _, node := range db {
+		if node.LocalStats == nil {
+			continue
+		}
+		topic := node.Root + "/2/" + TopicFormatEncrypted + "/" + node.Channel
+		if summary.Regions[node.MqttRegion] == nil {
+			summary.Regions[node.MqttRegion] = new(MeshHealth)
+		}
+		summary.Regions[node.MqttRegion].add(node.LocalStats, node.LastLocalStats)
+		if summary.Topics[topic] == nil {
+			summary.Topics[topic] = new(MeshHealth)
+		}
+		summary.Topics[topic].add(node.LocalStats, node.LastLocalStats)
+	}
+	return summary
+}
@@ -8,7 +8,8 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"regexp"
+	"sync"
+	"time"
 
 	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -22,6 +23,10 @@ var DefaultKey = []byte{
 	0xcf, 0x4e, 0x69, 0x01,
 }
 
+// ConnectWait is how long Connect waits for the first connection before
+// leaving it to retry in the background.
+const ConnectWait = 10 * time.Second
+
 func NewBlockCipher(key []byte) cipher.Block {
 	c, err := aes.NewCipher(key)
 	if err != nil {
@@ -30,58 +35,154 @@ func NewBlockCipher(key []byte) cipher.Block {
 	return c
 }
 
+// reasons envelopes are dropped by MQTTClient
+const (
+	DropTopicMismatch   = "topicMismatch"
+	DropGatewayMismatch = "gatewayMismatch" // topic and envelope gateway IDs differ
+	DropBadEnvelope     = "badEnvelope"
+	DropNoPacket        = "noPacket"
+	DropAnonymous       = "anonymous"
+	DropNoData          = "noData"
+	DropDecrypt         = "decryptFailed"
+	DropPKI             = "pkiNotOurs" // direct message to a node we have no key for
+	DropPKIDecrypt      = "pkiDecryptFailed"
+	DropPKIKeyConflict  = "pkiKeyConflict" // sender key differs from the pinned one
+)
+
+// Packet is a decoded MeshPacket along with where it was received.
+type Packet struct {
+	From      uint32
+	To        uint32
+	Id        uint32
+	Topic     string
+	Channel   string     // channel whose key decoded the packet
+	PKI       bool       // direct message decrypted with a PKIKeyring key
+	PublicKey []byte     // sender public key included in the MeshPacket, if any
+	Reception *Reception // the reception the packet was decoded from
+	PortNum   generated.PortNum
+	Payload   []byte
+	RequestId uint32  // for replies, the Id of the request
+	Request   *Packet // for replies, the request if it is still in the Dedupe cache
+}
+
+// RxTime returns when the packet was first received, in unix seconds.
+func (packet *Packet) RxTime() int64 {
+	return packet.Reception.RxTime
+}
+
+// BroadcastNum is the destination of packets sent to everyone on a channel.
+const BroadcastNum = 0xffffffff
+
+// IsBroadcast reports whether the packet was sent to everyone on its channel.
+func (packet *Packet) IsBroadcast() bool {
+	return packet.To == BroadcastNum && !packet.PKI
+}
+
 type MQTTClient struct {
 	Topics         []string
-	TopicRegex     *regexp.Regexp
-	Accept         func(from uint32) bool
-	BlockCipher    cipher.Block
-	MessageHandler func(from uint32, topic string, portNum generated.PortNum, payload []byte)
+	Accept         func(from uint32, rx *Reception) bool // called for every copy of a packet
+	AcceptPacket   func(from uint32) bool                // called once for a packet, after Accept
+	BlockCipher    cipher.Block                          // used for publishing, and for decrypting if Keyring is nil
+	Keyring        *Keyring
+	PKIKeyring     *PKIKeyring
+	Dedupe         *PacketCache // if set, each packet is handled once
+	MessageHandler func(packet *Packet)
+	// ReceptionHandler, if set, is called for every reception of a decoded
+	// packet, including the first one and duplicates from other gateways.
+	ReceptionHandler func(packet *Packet, rx *Reception)
+	// PublicKey returns the key to decrypt a PKI packet from a node with, given
+	// the key the packet carries and when it was received: the pinned key of
+	// the node, or the carried key if none is pinned yet. It returns false if
+	// the carried key conflicts with the pinned one. If not set, the carried
+	// key is used.
+	PublicKey func(nodeNum uint32, packetKey []byte, received int64) ([]byte, bool)
+	// Broker to connect to, from BrokersFromEnv if not set
+	Broker Broker
+	// DeadLetters, if set, keeps envelopes that could not be decrypted or parsed
+	DeadLetters *DeadLetterWriter
+	state       brokerState
+	dropsMu     sync.Mutex
+	drops       map[string]uint64
 	mqtt.Client
 }
 
 func (c *MQTTClient) Connect() error {
+	if c.Keyring == nil {
+		c.Keyring = new(Keyring)
+		c.Keyring.AddBlockCipher("", c.BlockCipher)
+	}
+	if len(c.Broker.URL) == 0 {
+		c.Broker = BrokersFromEnv()[0]
+	}
+	c.state.Name = c.Broker.Name
+	c.state.URL = c.Broker.URL
 	randomId := make([]byte, 4)
 	rand.Read(randomId)
 	opts := mqtt.NewClientOptions()
 
 	opts.SetClientID(fmt.Sprintf("meshobserv-%x", randomId))
-
-	broker := os.Getenv("MQTT_BROKER")
-	if broker == "" {
-		broker = "tcp://mqtt.meshtastic.org:1883"
-	}
-	opts.AddBroker(broker)
-
-	username := os.Getenv("MQTT_USERNAME")
-	if username == "" {
-		username = "meshdev"
-	}
-	password := os.Getenv("MQTT_PASSWORD")
-	if password == "" {
-		password = "large4cats"
+	opts.AddBroker(c.Broker.URL)
+	opts.SetUsername(c.Broker.Username)
+	opts.SetPassword(c.Broker.Password)
+	if c.Broker.UsesTLS() {
+		tlsConfig, err := c.Broker.TLSConfig()
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
 	}
-	opts.SetUsername(username)
-	opts.SetPassword(password)
 	opts.SetOrderMatters(false)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(30 * time.Second)
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("[warn] %v: connection lost: %v", c.Broker.Name, err)
+		c.state.update(false, err)
+	})
+	opts.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		log.Printf("[info] %v: reconnecting", c.Broker.Name)
+	})
 	opts.SetDefaultPublishHandler(c.handleMessage)
 	c.Client = mqtt.NewClient(opts)
+	c.state.update(false, nil)
+	// the token only completes once connected, as failed attempts are retried
 	token := c.Client.Connect()
-	<-token.Done()
+	if !token.WaitTimeout(ConnectWait) {
+		log.Printf("[warn] %v: not connected yet, retrying in the background", c.Broker.Name)
+		return nil
+	}
 	if err := token.Error(); err != nil {
+		c.state.update(false, err)
 		return err
 	}
-	log.Print("[info] connected")
+	return nil
+}
+
+// onConnect (re)subscribes to Topics, as subscriptions are lost with the session.
+func (c *MQTTClient) onConnect(client mqtt.Client) {
+	log.Printf("[info] %v: connected", c.Broker.Name)
+	c.state.update(true, nil)
 	topics := make(map[string]byte)
 	for _, topic := range c.Topics {
 		topics[topic] = 0
 	}
-	token = c.SubscribeMultiple(topics, nil)
-	<-token.Done()
-	if err := token.Error(); err != nil {
-		return err
-	}
-	log.Print("[info] subscribed")
-	return nil
+	go func() {
+		token := client.SubscribeMultiple(topics, nil)
+		<-token.Done()
+		if err := token.Error(); err != nil {
+			log.Printf("[error] %v: subscribe: %v", c.Broker.Name, err)
+			c.state.update(true, err)
+			return
+		}
+		log.Printf("[info] %v: subscribed", c.Broker.Name)
+	}()
+}
+
+// State returns the connection state of the broker.
+func (c *MQTTClient) State() BrokerState {
+	return c.state.get()
 }
 
 func (c *MQTTClient) Disconnect() {
@@ -91,56 +192,192 @@ func (c *MQTTClient) Disconnect() {
 }
 
 func (c *MQTTClient) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	c.HandleEnvelope(msg.Topic(), msg.Payload(), time.Now())
+}
+
+// drop counts a dropped envelope, and keeps it as a dead letter if it may be
+// readable later.
+func (c *MQTTClient) drop(topic, reason string, payload []byte) {
+	c.dropsMu.Lock()
+	if c.drops == nil {
+		c.drops = make(map[string]uint64)
+	}
+	c.drops[reason]++
+	c.dropsMu.Unlock()
+	if c.DeadLetters == nil {
+		return
+	}
+	switch reason {
+	case DropBadEnvelope, DropDecrypt, DropPKIDecrypt:
+		if err := c.DeadLetters.Write(topic, reason, payload); err != nil {
+			log.Printf("[error] write dead letter: %v", err)
+		}
+	}
+}
+
+// Drops returns the number of dropped envelopes by reason.
+func (c *MQTTClient) Drops() map[string]uint64 {
+	c.dropsMu.Lock()
+	defer c.dropsMu.Unlock()
+	drops := make(map[string]uint64, len(c.drops))
+	for reason, count := range c.drops {
+		drops[reason] = count
+	}
+	return drops
+}
+
+// HandleEnvelope handles a raw ServiceEnvelope received on topic.
+func (c *MQTTClient) HandleEnvelope(topic string, payload []byte, received time.Time) {
 	// filter topic
-	topic := msg.Topic()
-	if !c.TopicRegex.MatchString(topic) {
+	parsed, err := ParseTopic(topic)
+	if err != nil || parsed.Format == TopicFormatJSON {
+		c.drop(topic, DropTopicMismatch, payload)
 		return
 	}
 	// parse ServiceEnvelope
 	var envelope generated.ServiceEnvelope
-	if err := proto.Unmarshal(msg.Payload(), &envelope); err != nil {
+	if err := proto.Unmarshal(payload, &envelope); err != nil {
 		log.Printf("[warn] could not parse ServiceEnvelope on %v: %v", topic, err)
+		c.drop(topic, DropBadEnvelope, payload)
 		return
 	}
 	// get MeshPacket
 	packet := envelope.GetPacket()
 	if packet == nil {
 		log.Printf("[warn] skipping ServiceEnvelope with no MeshPacket on %v", topic)
+		c.drop(topic, DropNoPacket, payload)
 		return
 	}
 	// no anonymous packets
 	from := packet.GetFrom()
 	if from == 0 {
 		log.Printf("[warn] skipping MeshPacket from unknown on %v", topic)
+		c.drop(topic, DropAnonymous, payload)
+		return
+	}
+	// check the gateway, map reports only have it in the envelope
+	gateway := envelope.GetGatewayId()
+	if len(gateway) == 0 {
+		gateway = parsed.Gateway
+	} else if len(parsed.Gateway) > 0 && gateway != parsed.Gateway {
+		log.Printf("[warn] skipping ServiceEnvelope from gateway %v on %v", gateway, topic)
+		c.drop(topic, DropGatewayMismatch, payload)
 		return
 	}
-	// check sender
-	if c.Accept != nil && !c.Accept(from) {
+	// record the reception, and only handle the first copy of a packet
+	rx := &Reception{
+		Gateway:  gateway,
+		Topic:    topic,
+		Root:     parsed.Root,
+		Region:   parsed.Region,
+		Channel:  parsed.Channel,
+		RxSnr:    packet.GetRxSnr(),
+		RxRssi:   packet.GetRxRssi(),
+		HopsAway: -1,
+		RxTime:   received.Unix(),
+	}
+	if hopStart := packet.GetHopStart(); hopStart > 0 && hopStart >= packet.GetHopLimit() {
+		rx.HopsAway = int32(hopStart - packet.GetHopLimit())
+	}
+	// check sender and where this copy came from
+	if c.Accept != nil && !c.Accept(from, rx) {
 		return
 	}
+	var admit func() bool
+	if c.AcceptPacket != nil {
+		admit = func() bool { return c.AcceptPacket(from) }
+	}
+	if c.Dedupe != nil && packet.GetId() != 0 {
+		first, decoded := c.Dedupe.Add(from, packet.GetId(), rx, admit)
+		if !first {
+			if decoded != nil && c.ReceptionHandler != nil {
+				c.ReceptionHandler(decoded, rx)
+			}
+			return
+		}
+	} else if admit != nil && !admit() {
+		return
+	}
+	// the channel the packet claims to be on, used to pick candidate keys
+	channel := envelope.GetChannelId()
+	if len(channel) == 0 {
+		channel = parsed.Channel
+	}
 	// get Data, try decoded first
 	data := packet.GetDecoded()
+	pki := false
 	if data == nil {
 		// data must be (probably) encrypted
 		encrypted := packet.GetEncrypted()
 		if encrypted == nil {
 			log.Printf("[warn] skipping MeshPacket from %v with no data on %v", from, topic)
+			c.drop(topic, DropNoData, payload)
 			return
 		}
-		// decrypt
-		nonce := make([]byte, 16)
-		binary.LittleEndian.PutUint32(nonce[0:], packet.GetId())
-		binary.LittleEndian.PutUint32(nonce[8:], from)
-		decrypted := make([]byte, len(encrypted))
-		cipher.NewCTR(c.BlockCipher, nonce).XORKeyStream(decrypted, encrypted)
-		// parse Data
-		data = new(generated.Data)
-		if err := proto.Unmarshal(decrypted, data); err != nil {
-			// ignore, probably encrypted with other psk
-			return
+		if packet.GetPkiEncrypted() {
+			// direct message, only readable if addressed to one of our nodes
+			if c.PKIKeyring == nil || !c.PKIKeyring.Has(packet.GetTo()) {
+				c.drop(topic, DropPKI, payload)
+				return
+			}
+			// never trust the key in the packet over the pinned one
+			senderKey := packet.GetPublicKey()
+			if c.PublicKey != nil {
+				var ok bool
+				senderKey, ok = c.PublicKey(from, senderKey, rx.RxTime)
+				if !ok {
+					log.Printf("[warn] skipping PKI MeshPacket from %v on %v with a conflicting public key", from, topic)
+					c.drop(topic, DropPKIKeyConflict, payload)
+					return
+				}
+			}
+			data, err = c.PKIKeyring.Decrypt(from, packet.GetTo(), packet.GetId(), senderKey, encrypted)
+			if err != nil {
+				log.Printf("[warn] could not decrypt PKI MeshPacket from %v to %v on %v: %v", from, packet.GetTo(), topic, err)
+				c.drop(topic, DropPKIDecrypt, payload)
+				return
+			}
+			channel, pki = "", true
+		} else {
+			// decrypt
+			var ok bool
+			data, channel, ok = c.Keyring.Decrypt(channel, packet.GetChannel(), packet.GetId(), from, encrypted)
+			if !ok {
+				// probably encrypted with a psk we don't have
+				c.drop(topic, DropDecrypt, payload)
+				return
+			}
+		}
+	}
+	decoded := &Packet{
+		From:      from,
+		To:        packet.GetTo(),
+		Id:        packet.GetId(),
+		Topic:     topic,
+		Channel:   channel,
+		PKI:       pki,
+		PublicKey: packet.GetPublicKey(),
+		Reception: rx,
+		PortNum:   data.GetPortnum(),
+		Payload:   data.GetPayload(),
+		RequestId: data.GetRequestId(),
+	}
+	if c.Dedupe != nil && decoded.RequestId != 0 {
+		// replies go back to the sender of the request
+		decoded.Request = c.Dedupe.Packet(decoded.To, decoded.RequestId)
+	}
+	var pending []*Reception
+	if c.Dedupe != nil && packet.GetId() != 0 {
+		pending = c.Dedupe.SetPacket(decoded)
+	}
+	if c.ReceptionHandler != nil {
+		c.ReceptionHandler(decoded, rx)
+		// duplicates that arrived while this copy was being decoded
+		for _, rx := range pending {
+			c.ReceptionHandler(decoded, rx)
 		}
 	}
-	c.MessageHandler(from, topic, data.GetPortnum(), data.GetPayload())
+	c.MessageHandler(decoded)
 }
 
 func init() {
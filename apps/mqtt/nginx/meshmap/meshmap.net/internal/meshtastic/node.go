@@ -2,8 +2,13 @@ package meshtastic
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,11 +25,65 @@ func cleanFloat(f float32) float32 {
 	return f
 }
 
+// ParseNodeNum parses a node number given in decimal or as a !hex node ID.
+func ParseNodeNum(s string) (uint32, error) {
+	var n uint64
+	var err error
+	if hexId, found := strings.CutPrefix(s, "!"); found {
+		n, err = strconv.ParseUint(hexId, 16, 32)
+	} else {
+		n, err = strconv.ParseUint(s, 10, 32)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid node number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// NodeId formats a node number as a !hex node ID.
+func NodeId(nodeNum uint32) string {
+	return fmt.Sprintf("!%08x", nodeNum)
+}
+
 type NeighborInfo struct {
 	Snr     float32 `json:"snr,omitempty"`
 	Updated int64   `json:"updated"`
 }
 
+// SeenBy is how a single gateway has been hearing a node.
+type SeenBy struct {
+	Topic    string   `json:"topic"`
+	Root     string   `json:"root,omitempty"`
+	Channel  string   `json:"channel,omitempty"` // empty for map reports
+	LastSnr  float32  `json:"lastSnr,omitempty"`
+	LastRssi int32    `json:"lastRssi,omitempty"`
+	BestSnr  float32  `json:"bestSnr,omitempty"`
+	BestRssi int32    `json:"bestRssi,omitempty"`
+	HopsAway int32    `json:"hopsAway"` // -1 if unknown
+	Packets  uint32   `json:"packets"`
+	PortNums []string `json:"portNums,omitempty"`
+	Updated  int64    `json:"updated"`
+}
+
+// UnmarshalJSON also accepts the old format, a bare last seen time.
+func (seenBy *SeenBy) UnmarshalJSON(b []byte) error {
+	var updated int64
+	if err := json.Unmarshal(b, &updated); err == nil {
+		*seenBy = SeenBy{HopsAway: -1, Updated: updated}
+		return nil
+	}
+	type plain SeenBy
+	return json.Unmarshal(b, (*plain)(seenBy))
+}
+
+// HealthMetrics is a reading from a wearable health sensor.
+type HealthMetrics struct {
+	HeartBpm    uint32  `json:"heartBpm,omitempty"`
+	SpO2        uint32  `json:"spO2,omitempty"`        // %
+	Temperature float32 `json:"temperature,omitempty"` // body, °C
+	Updated     int64   `json:"updated"`
+}
+
 type Node struct {
 	// User
 	LongName  string `json:"longName"`
@@ -32,6 +91,15 @@ type Node struct {
 	HwModel   string `json:"hwModel"`
 	Role      string `json:"role"`
 	PublicKey string `json:"publicKey"`
+	LastUser  int64  `json:"lastUser,omitempty"`
+	// a NODEINFO with a key other than the pinned PublicKey, suspected impostor
+	KeyConflict     string `json:"keyConflict,omitempty"`
+	LastKeyConflict int64  `json:"lastKeyConflict,omitempty"`
+	// Channel the node's last packet was decoded on
+	Channel string `json:"channel,omitempty"`
+	// MQTT root topic and its region (e.g. msh/US/NV and US) the node was last heard on
+	Root       string `json:"root,omitempty"`
+	MqttRegion string `json:"mqttRegion,omitempty"`
 	// MapReport
 	FwVersion        string `json:"fwVersion,omitempty"`
 	Region           string `json:"region,omitempty"`
@@ -44,6 +112,8 @@ type Node struct {
 	Longitude int32  `json:"longitude"`
 	Altitude  int32  `json:"altitude,omitempty"`
 	Precision uint32 `json:"precision,omitempty"`
+	*PositionFix
+	LastPosition int64 `json:"lastPosition,omitempty"`
 	// DeviceMetrics
 	BatteryLevel      uint32  `json:"batteryLevel,omitempty"`
 	Voltage           float32 `json:"voltage,omitempty"`
@@ -63,15 +133,42 @@ type Node struct {
 	Rainfall1              float32 `json:"rainfall1,omitempty"`
 	Rainfall24             float32 `json:"rainfall24,omitempty"`
 	LastEnvironmentMetrics int64   `json:"lastEnvironmentMetrics,omitempty"`
+	// AirQualityMetrics
+	*AirQuality
+	LastAirQuality int64 `json:"lastAirQuality,omitempty"`
+	// PowerMetrics
+	Ch1Voltage       float32 `json:"ch1Voltage,omitempty"`
+	Ch1Current       float32 `json:"ch1Current,omitempty"`
+	Ch2Voltage       float32 `json:"ch2Voltage,omitempty"`
+	Ch2Current       float32 `json:"ch2Current,omitempty"`
+	Ch3Voltage       float32 `json:"ch3Voltage,omitempty"`
+	Ch3Current       float32 `json:"ch3Current,omitempty"`
+	LastPowerMetrics int64   `json:"lastPowerMetrics,omitempty"`
+	// HealthMetrics, only written to the restricted view from NodeDB.GetHealthMetrics
+	Health *HealthMetrics `json:"-"`
+	// LocalStats
+	LocalStats     *LocalStats `json:"localStats,omitempty"`
+	LastLocalStats int64       `json:"lastLocalStats,omitempty"`
+	// Paxcount
+	PaxWifi      uint32 `json:"paxWifi,omitempty"`
+	PaxBle       uint32 `json:"paxBle,omitempty"`
+	LastPaxcount int64  `json:"lastPaxcount,omitempty"`
+	// DetectionSensor
+	DetectionText string `json:"detectionText,omitempty"`
+	LastDetection int64  `json:"lastDetection,omitempty"` // last triggered
+	// StoreAndForward, if the node is a router
+	StoreForward *StoreForward `json:"storeForward,omitempty"`
 	// NeighborInfo
 	Neighbors map[uint32]*NeighborInfo `json:"neighbors,omitempty"`
-	// key=mqtt topic, value=first seen/last position update
-	SeenBy map[string]int64 `json:"seenBy"`
+	// key=transmitting node, links to this node seen in traceroutes
+	RouteHops map[uint32]*RouteHop `json:"routeHops,omitempty"`
+	// key=gateway id (or mqtt topic if unknown)
+	SeenBy map[string]*SeenBy `json:"seenBy"`
 }
 
-func NewNode(topic string) *Node {
+func NewNode() *Node {
 	return &Node{
-		SeenBy: map[string]int64{topic: time.Now().Unix()},
+		SeenBy: make(map[string]*SeenBy),
 	}
 }
 
@@ -98,6 +195,49 @@ func (node *Node) ClearEnvironmentMetrics() {
 	node.LastEnvironmentMetrics = 0
 }
 
+func (node *Node) ClearAirQuality() {
+	node.AirQuality = nil
+	node.LastAirQuality = 0
+}
+
+func (node *Node) ClearLocalStats() {
+	node.LocalStats = nil
+	node.LastLocalStats = 0
+}
+
+func (node *Node) ClearPaxcount() {
+	node.PaxWifi = 0
+	node.PaxBle = 0
+	node.LastPaxcount = 0
+}
+
+func (node *Node) ClearPositionFix() {
+	node.PositionFix = nil
+}
+
+func (node *Node) ClearPowerMetrics() {
+	node.Ch1Voltage = 0
+	node.Ch1Current = 0
+	node.Ch2Voltage = 0
+	node.Ch2Current = 0
+	node.Ch3Voltage = 0
+	node.Ch3Current = 0
+	node.LastPowerMetrics = 0
+}
+
+func (node *Node) ClearHealthMetrics() {
+	node.Health = nil
+}
+
+func (node *Node) ClearStoreForward() {
+	node.StoreForward = nil
+}
+
+func (node *Node) ClearKeyConflict() {
+	node.KeyConflict = ""
+	node.LastKeyConflict = 0
+}
+
 func (node *Node) ClearMapReportData() {
 	node.FwVersion = ""
 	node.Region = ""
@@ -123,16 +263,16 @@ func (node *Node) IsValid() bool {
 func (node *Node) Prune(seenByTtl, neighborTtl, metricsTtl, mapReportTtl int64) {
 	now := time.Now().Unix()
 	// SeenBy
-	for topic, lastSeen := range node.SeenBy {
-		if lastSeen+seenByTtl < now {
-			delete(node.SeenBy, topic)
+	for gateway, seenBy := range node.SeenBy {
+		if seenBy.Updated+seenByTtl < now {
+			delete(node.SeenBy, gateway)
 		}
 	}
 	for len(node.SeenBy) > SeenByLimit {
 		var toDelete string
-		for topic, lastSeen := range node.SeenBy {
-			if len(toDelete) == 0 || lastSeen < node.SeenBy[toDelete] {
-				toDelete = topic
+		for gateway, seenBy := range node.SeenBy {
+			if len(toDelete) == 0 || seenBy.Updated < node.SeenBy[toDelete].Updated {
+				toDelete = gateway
 			}
 		}
 		delete(node.SeenBy, toDelete)
@@ -155,6 +295,24 @@ func (node *Node) Prune(seenByTtl, neighborTtl, metricsTtl, mapReportTtl int64)
 		}
 		delete(node.Neighbors, toDelete)
 	}
+	// RouteHops
+	for hopNum, hop := range node.RouteHops {
+		if hop.Updated+neighborTtl < now {
+			delete(node.RouteHops, hopNum)
+		}
+	}
+	if len(node.RouteHops) == 0 {
+		node.RouteHops = nil
+	}
+	for len(node.RouteHops) > NeighborLimit {
+		var toDelete uint32
+		for hopNum, hop := range node.RouteHops {
+			if toDelete == 0 || hop.Updated < node.RouteHops[toDelete].Updated {
+				toDelete = hopNum
+			}
+		}
+		delete(node.RouteHops, toDelete)
+	}
 	// DeviceMetrics
 	if node.LastDeviceMetrics > 0 && node.LastDeviceMetrics+metricsTtl < now {
 		node.ClearDeviceMetrics()
@@ -163,22 +321,85 @@ func (node *Node) Prune(seenByTtl, neighborTtl, metricsTtl, mapReportTtl int64)
 	if node.LastEnvironmentMetrics > 0 && node.LastEnvironmentMetrics+metricsTtl < now {
 		node.ClearEnvironmentMetrics()
 	}
+	// AirQualityMetrics
+	if node.LastAirQuality > 0 && node.LastAirQuality+metricsTtl < now {
+		node.ClearAirQuality()
+	}
+	// PositionFix, stale speed and track are misleading
+	if node.PositionFix != nil && node.LastPosition+metricsTtl < now {
+		node.ClearPositionFix()
+	}
+	// PowerMetrics
+	if node.LastPowerMetrics > 0 && node.LastPowerMetrics+metricsTtl < now {
+		node.ClearPowerMetrics()
+	}
+	// HealthMetrics
+	if node.Health != nil && node.Health.Updated+metricsTtl < now {
+		node.ClearHealthMetrics()
+	}
+	// LocalStats
+	if node.LastLocalStats > 0 && node.LastLocalStats+metricsTtl < now {
+		node.ClearLocalStats()
+	}
+	// Paxcount
+	if node.LastPaxcount > 0 && node.LastPaxcount+metricsTtl < now {
+		node.ClearPaxcount()
+	}
+	// StoreAndForward
+	if node.StoreForward != nil && node.StoreForward.Updated+metricsTtl < now {
+		node.ClearStoreForward()
+	}
+	// KeyConflict
+	if node.LastKeyConflict > 0 && node.LastKeyConflict+seenByTtl < now {
+		node.ClearKeyConflict()
+	}
 	// MapReport
 	if node.LastMapReport > 0 && node.LastMapReport+mapReportTtl < now {
 		node.ClearMapReportData()
 	}
 }
 
-func (node *Node) UpdateDeviceMetrics(batteryLevel uint32, voltage, chUtil, airUtilTx float32, uptime uint32) {
+// The Update methods take the time the data was received, and ignore data
+// older than what the node has, such as replayed dead letters.
+
+func (node *Node) UpdateAirQuality(airQuality *AirQuality, updated int64) {
+	if updated < node.LastAirQuality {
+		return
+	}
+	node.AirQuality = airQuality
+	node.LastAirQuality = updated
+}
+
+func (node *Node) UpdateChannel(channel string) {
+	if len(channel) > 0 {
+		node.Channel = channel
+	}
+}
+
+func (node *Node) UpdateDeviceMetrics(batteryLevel uint32, voltage, chUtil, airUtilTx float32, uptime uint32, updated int64) {
+	if updated < node.LastDeviceMetrics {
+		return
+	}
 	node.BatteryLevel = batteryLevel
 	node.Voltage = cleanFloat(voltage)
 	node.ChUtil = cleanFloat(chUtil)
 	node.AirUtilTx = cleanFloat(airUtilTx)
 	node.Uptime = uptime
-	node.LastDeviceMetrics = time.Now().Unix()
+	node.LastDeviceMetrics = updated
+}
+
+func (node *Node) UpdateDetection(text string, triggered int64) {
+	if triggered < node.LastDetection {
+		return
+	}
+	node.DetectionText = text
+	node.LastDetection = triggered
 }
 
-func (node *Node) UpdateEnvironmentMetrics(temperature, relativeHumidity, barometricPressure, lux float32, windDirection uint32, windSpeed, windGust, radiation, rainfall1, rainfall24 float32) {
+func (node *Node) UpdateEnvironmentMetrics(temperature, relativeHumidity, barometricPressure, lux float32, windDirection uint32, windSpeed, windGust, radiation, rainfall1, rainfall24 float32, updated int64) {
+	if updated < node.LastEnvironmentMetrics {
+		return
+	}
 	node.Temperature = cleanFloat(temperature)
 	node.RelativeHumidity = cleanFloat(relativeHumidity)
 	node.BarometricPressure = cleanFloat(barometricPressure)
@@ -189,40 +410,166 @@ func (node *Node) UpdateEnvironmentMetrics(temperature, relativeHumidity, barome
 	node.Radiation = cleanFloat(radiation)
 	node.Rainfall1 = cleanFloat(rainfall1)
 	node.Rainfall24 = cleanFloat(rainfall24)
-	node.LastEnvironmentMetrics = time.Now().Unix()
+	node.LastEnvironmentMetrics = updated
+}
+
+func (node *Node) UpdateHealthMetrics(heartBpm, spO2 uint32, temperature float32, updated int64) {
+	if node.Health != nil && updated < node.Health.Updated {
+		return
+	}
+	node.Health = &HealthMetrics{
+		HeartBpm:    heartBpm,
+		SpO2:        spO2,
+		Temperature: cleanFloat(temperature),
+		Updated:     updated,
+	}
+}
+
+func (node *Node) UpdateKeyConflict(pubKey string, updated int64) {
+	node.KeyConflict = pubKey
+	node.LastKeyConflict = max(node.LastKeyConflict, updated)
 }
 
-func (node *Node) UpdateMapReport(fwVersion, region, modemPreset string, hasDefaultCh bool, onlineLocalNodes uint32) {
+// UpdateLocalStats stores stats along with the counter increases since the previous report.
+func (node *Node) UpdateLocalStats(stats *LocalStats, updated int64) {
+	if updated < node.LastLocalStats {
+		return
+	}
+	stats.ChUtil = cleanFloat(stats.ChUtil)
+	stats.AirUtilTx = cleanFloat(stats.AirUtilTx)
+	stats.Delta = stats.deltaSince(node.LocalStats)
+	node.LocalStats = stats
+	node.LastLocalStats = updated
+}
+
+func (node *Node) UpdateMapReport(fwVersion, region, modemPreset string, hasDefaultCh bool, onlineLocalNodes uint32, updated int64) {
+	if updated < node.LastMapReport {
+		return
+	}
 	node.FwVersion = fwVersion
 	node.Region = region
 	node.ModemPreset = modemPreset
 	node.HasDefaultCh = hasDefaultCh
 	node.OnlineLocalNodes = onlineLocalNodes
-	node.LastMapReport = time.Now().Unix()
+	node.LastMapReport = updated
 }
 
-func (node *Node) UpdateNeighborInfo(neighborNum uint32, snr float32) {
+func (node *Node) UpdateNeighborInfo(neighborNum uint32, snr float32, updated int64) {
 	if node.Neighbors == nil {
 		node.Neighbors = make(map[uint32]*NeighborInfo)
 	}
+	if neighbor := node.Neighbors[neighborNum]; neighbor != nil && updated < neighbor.Updated {
+		return
+	}
 	node.Neighbors[neighborNum] = &NeighborInfo{
 		Snr:     cleanFloat(snr),
-		Updated: time.Now().Unix(),
+		Updated: updated,
+	}
+}
+
+func (node *Node) UpdateRouteHop(hopNum uint32, snr float32, updated int64) {
+	if node.RouteHops == nil {
+		node.RouteHops = make(map[uint32]*RouteHop)
+	}
+	hop := node.RouteHops[hopNum]
+	if hop == nil {
+		hop = &RouteHop{Snr: cleanFloat(snr)}
+		node.RouteHops[hopNum] = hop
 	}
+	hop.Snr = hop.Snr*0.75 + cleanFloat(snr)*0.25
+	hop.Count++
+	hop.Updated = max(hop.Updated, updated)
 }
 
-func (node *Node) UpdatePosition(latitude, longitude, altitude int32, precision uint32) {
+func (node *Node) UpdatePaxcount(wifi, ble uint32, updated int64) {
+	if updated < node.LastPaxcount {
+		return
+	}
+	node.PaxWifi = wifi
+	node.PaxBle = ble
+	node.LastPaxcount = updated
+}
+
+// UpdatePosition reports whether the position was updated, so details of the
+// same fix can follow.
+func (node *Node) UpdatePosition(latitude, longitude, altitude int32, precision uint32, updated int64) bool {
+	if updated < node.LastPosition {
+		return false
+	}
 	node.Latitude = latitude
 	node.Longitude = longitude
 	node.Altitude = altitude
 	node.Precision = precision
+	node.LastPosition = updated
+	return true
+}
+
+func (node *Node) UpdatePositionFix(fix *PositionFix) {
+	node.PositionFix = fix
+}
+
+func (node *Node) UpdatePowerMetrics(ch1Voltage, ch1Current, ch2Voltage, ch2Current, ch3Voltage, ch3Current float32, updated int64) {
+	if updated < node.LastPowerMetrics {
+		return
+	}
+	node.Ch1Voltage = cleanFloat(ch1Voltage)
+	node.Ch1Current = cleanFloat(ch1Current)
+	node.Ch2Voltage = cleanFloat(ch2Voltage)
+	node.Ch2Current = cleanFloat(ch2Current)
+	node.Ch3Voltage = cleanFloat(ch3Voltage)
+	node.Ch3Current = cleanFloat(ch3Current)
+	node.LastPowerMetrics = updated
+}
+
+func (node *Node) UpdateSeenBy(rx *Reception, portNum string) {
+	key := rx.Gateway
+	if len(key) == 0 {
+		key = rx.Topic
+	}
+	seenBy := node.SeenBy[key]
+	if seenBy == nil {
+		seenBy = new(SeenBy)
+		node.SeenBy[key] = seenBy
+	}
+	seenBy.Topic = rx.Topic
+	seenBy.Root = rx.Root
+	seenBy.Channel = rx.Channel
+	node.Root = rx.Root
+	node.MqttRegion = rx.Region
+	// gateways don't report signal quality for their own packets
+	if rx.RxRssi != 0 {
+		snr := cleanFloat(rx.RxSnr)
+		seenBy.LastSnr = snr
+		seenBy.LastRssi = rx.RxRssi
+		if seenBy.BestRssi == 0 || snr > seenBy.BestSnr {
+			seenBy.BestSnr = snr
+		}
+		if seenBy.BestRssi == 0 || rx.RxRssi > seenBy.BestRssi {
+			seenBy.BestRssi = rx.RxRssi
+		}
+	}
+	seenBy.HopsAway = rx.HopsAway
+	seenBy.Packets++
+	if !slices.Contains(seenBy.PortNums, portNum) {
+		seenBy.PortNums = append(seenBy.PortNums, portNum)
+		slices.Sort(seenBy.PortNums)
+	}
+	seenBy.Updated = rx.RxTime
 }
 
-func (node *Node) UpdateSeenBy(topic string) {
-	node.SeenBy[topic] = time.Now().Unix()
+// UpdateStoreForward marks the node as heard from as a Store & Forward router.
+func (node *Node) UpdateStoreForward(updated int64) *StoreForward {
+	if node.StoreForward == nil {
+		node.StoreForward = new(StoreForward)
+	}
+	node.StoreForward.Updated = max(node.StoreForward.Updated, updated)
+	return node.StoreForward
 }
 
-func (node *Node) UpdateUser(longName, shortName, hwModel, role, pubKey string) {
+func (node *Node) UpdateUser(longName, shortName, hwModel, role, pubKey string, updated int64) {
+	if updated < node.LastUser {
+		return
+	}
 	node.LongName = longName
 	node.ShortName = shortName
 	node.HwModel = hwModel
@@ -230,6 +577,7 @@ func (node *Node) UpdateUser(longName, shortName, hwModel, role, pubKey string)
 	if pubKey != "" {
 		node.PublicKey = pubKey
 	}
+	node.LastUser = updated
 }
 
 type NodeDB map[uint32]*Node
@@ -243,6 +591,30 @@ func (db NodeDB) Prune(seenByTtl, neighborTtl, metricsTtl, mapReportTtl int64) {
 	}
 }
 
+// CountByRegion counts nodes by MQTT region and channel.
+func (db NodeDB) CountByRegion() map[string]map[string]int {
+	counts := make(map[string]map[string]int)
+	for _, node := range db {
+		if counts[node.MqttRegion] == nil {
+			counts[node.MqttRegion] = make(map[string]int)
+		}
+		counts[node.MqttRegion][node.Channel]++
+	}
+	return counts
+}
+
+// GetHealthMetrics returns the health metrics of the nodes reporting them,
+// which are personal data and left out of the public node database.
+func (db NodeDB) GetHealthMetrics() map[uint32]*HealthMetrics {
+	health := make(map[uint32]*HealthMetrics)
+	for nodeNum, node := range db {
+		if node.Health != nil {
+			health[nodeNum] = node.Health
+		}
+	}
+	return health
+}
+
 func (db NodeDB) GetValid() NodeDB {
 	valid := make(NodeDB)
 	for nodeNum, node := range db {
@@ -254,26 +626,50 @@ func (db NodeDB) GetValid() NodeDB {
 }
 
 func (db *NodeDB) LoadFile(path string) error {
+	return LoadJSONFile(path, db)
+}
+
+func (db NodeDB) WriteFile(path string) error {
+	return WriteJSONFile(path, db)
+}
+
+// LoadJSONFile decodes the JSON file at path into v.
+func LoadJSONFile(path string, v any) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return json.NewDecoder(f).Decode(db)
+	return json.NewDecoder(f).Decode(v)
 }
 
-func (db NodeDB) WriteFile(path string) error {
+// WriteJSONFile atomically replaces the file at path with v encoded as JSON.
+func WriteJSONFile(path string, v any) error {
+	return writeFile(path, 0644, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+// WritePrivateJSONFile is WriteJSONFile for files only their owner may read.
+func WritePrivateJSONFile(path string, v any) error {
+	return writeFile(path, 0600, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+// writeFile atomically replaces the file at path with what write writes.
+func writeFile(path string, perm os.FileMode, write func(w io.Writer) error) error {
 	dir, file := filepath.Split(path)
 	f, err := os.CreateTemp(dir, file)
 	if err != nil {
 		return err
 	}
-	err = json.NewEncoder(f).Encode(db)
+	err = write(f)
 	if err1 := f.Close(); err1 != nil && err == nil {
 		err = err1
 	}
 	if err == nil {
-		err = os.Chmod(f.Name(), 0644)
+		err = os.Chmod(f.Name(), perm)
 	}
 	if err == nil {
 		err = os.Rename(f.Name(), path)
@@ -0,0 +1,120 @@
+package meshtastic
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	PaxSampleLimit = 1000 // per node
+	// positions coarser than this (about ±22 m) don't say which density cell a crowd is in
+	DensityMinPrecision = 20
+)
+
+// PaxSample is a paxcounter reading.
+type PaxSample struct {
+	Wifi   uint32 `json:"wifi"`
+	Ble    uint32 `json:"ble"`
+	Uptime uint32 `json:"uptime,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// PaxDB holds the paxcounter readings of each node, oldest first.
+type PaxDB map[uint32][]*PaxSample
+
+// Add inserts a reading in time order, so replayed readings don't hold back Prune.
+func (db PaxDB) Add(nodeNum, wifi, ble, uptime uint32, received int64) {
+	samples := db[nodeNum]
+	i := len(samples)
+	for i > 0 && samples[i-1].Time > received {
+		i--
+	}
+	samples = slices.Insert(samples, i, &PaxSample{
+		Wifi:   wifi,
+		Ble:    ble,
+		Uptime: uptime,
+		Time:   received,
+	})
+	if len(samples) > PaxSampleLimit {
+		samples = samples[len(samples)-PaxSampleLimit:]
+	}
+	db[nodeNum] = samples
+}
+
+func (db PaxDB) Prune(ttl int64) {
+	now := time.Now().Unix()
+	for nodeNum, samples := range db {
+		for len(samples) > 0 && samples[0].Time+ttl < now {
+			samples = samples[1:]
+		}
+		if len(samples) == 0 {
+			delete(db, nodeNum)
+		} else {
+			db[nodeNum] = samples
+		}
+	}
+}
+
+func (db *PaxDB) LoadFile(path string) error {
+	return LoadJSONFile(path, db)
+}
+
+func (db PaxDB) WriteFile(path string) error {
+	return WriteJSONFile(path, db)
+}
+
+// DensityCell is a grid cell with the latest paxcounts of the nodes in it summed.
+type DensityCell struct {
+	Latitude  int32    `json:"latitude"` // center
+	Longitude int32    `json:"longitude"`
+	Wifi      uint32   `json:"wifi"`
+	Ble       uint32   `json:"ble"`
+	Pax       uint32   `json:"pax"`
+	Nodes     []uint32 `json:"nodes"`
+	Updated   int64    `json:"updated"`
+}
+
+// DensityGrid is crowd density on a grid of CellSize by CellSize degrees * 1e-7.
+type DensityGrid struct {
+	CellSize int32          `json:"cellSize"`
+	Cells    []*DensityCell `json:"cells"`
+}
+
+// GetDensityGrid combines the latest paxcounts of nodes with their positions.
+func (db NodeDB) GetDensityGrid(cellSize int32) *DensityGrid {
+	type cellKey struct{ lat, lon int32 }
+	cells := make(map[cellKey]*DensityCell)
+	grid := &DensityGrid{CellSize: cellSize, Cells: []*DensityCell{}}
+	for nodeNum, node := range db {
+		if node.LastPaxcount == 0 || (node.Latitude == 0 && node.Longitude == 0) {
+			continue
+		}
+		if node.Precision > 0 && node.Precision < DensityMinPrecision {
+			continue
+		}
+		key := cellKey{floorDiv(node.Latitude, cellSize), floorDiv(node.Longitude, cellSize)}
+		cell := cells[key]
+		if cell == nil {
+			cell = &DensityCell{
+				Latitude:  key.lat*cellSize + cellSize/2,
+				Longitude: key.lon*cellSize + cellSize/2,
+			}
+			cells[key] = cell
+			grid.Cells = append(grid.Cells, cell)
+		}
+		cell.Wifi += node.PaxWifi
+		cell.Ble += node.PaxBle
+		cell.Pax += node.PaxWifi + node.PaxBle
+		cell.Nodes = append(cell.Nodes, nodeNum)
+		cell.Updated = max(cell.Updated, node.LastPaxcount)
+	}
+	return grid
+}
+
+func floorDiv(a, b int32) int32 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
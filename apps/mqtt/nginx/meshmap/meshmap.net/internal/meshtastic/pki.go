@@ -0,0 +1,180 @@
+package meshtastic
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	pkiTagSize   = 8  // AES-CCM auth tag length (M)
+	pkiNonceSize = 13 // AES-CCM nonce length for a 2-byte length field (L)
+	pkiOverhead  = pkiTagSize + 4
+)
+
+var (
+	ErrNoPrivateKey = errors.New("no private key for recipient")
+	ErrNoPublicKey  = errors.New("no public key for sender")
+	ErrPKIAuth      = errors.New("message authentication failed")
+)
+
+// PKIKeyring holds the Curve25519 private keys of nodes whose direct messages we decrypt.
+type PKIKeyring struct {
+	keys map[uint32]*ecdh.PrivateKey
+}
+
+// Add adds the raw 32-byte private key of nodeNum.
+func (k *PKIKeyring) Add(nodeNum uint32, privateKey []byte) error {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	if k.keys == nil {
+		k.keys = make(map[uint32]*ecdh.PrivateKey)
+	}
+	k.keys[nodeNum] = key
+	return nil
+}
+
+// Len returns the number of keys in the keyring.
+func (k *PKIKeyring) Len() int {
+	return len(k.keys)
+}
+
+// Parse adds keys from "node=base64key" entries, where node is a node number or !id.
+func (k *PKIKeyring) Parse(entries ...string) error {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		node, key, found := strings.Cut(entry, "=")
+		if !found {
+			return fmt.Errorf("invalid PKI keyring entry %q", entry)
+		}
+		nodeNum, err := ParseNodeNum(strings.TrimSpace(node))
+		if err != nil {
+			return err
+		}
+		rawKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return fmt.Errorf("invalid private key for node %v: %w", nodeNum, err)
+		}
+		if err := k.Add(nodeNum, rawKey); err != nil {
+			return fmt.Errorf("invalid private key for node %v: %w", nodeNum, err)
+		}
+	}
+	return nil
+}
+
+// LoadFile adds keys from a file with one "node=base64key" entry per line.
+func (k *PKIKeyring) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if err := k.Parse(s.Text()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// Has reports whether the keyring can decrypt messages addressed to nodeNum.
+func (k *PKIKeyring) Has(nodeNum uint32) bool {
+	_, found := k.keys[nodeNum]
+	return found
+}
+
+// Decrypt decrypts a PKI direct message the way the firmware does: the AES-256
+// key is the SHA-256 of the X25519 shared secret, and the ciphertext is
+// followed by an 8-byte AES-CCM tag and a 4-byte extra nonce.
+func (k *PKIKeyring) Decrypt(from, to, packetId uint32, senderKey, encrypted []byte) (*generated.Data, error) {
+	privateKey := k.keys[to]
+	if privateKey == nil {
+		return nil, ErrNoPrivateKey
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(senderKey)
+	if err != nil {
+		return nil, ErrNoPublicKey
+	}
+	if len(encrypted) < pkiOverhead {
+		return nil, fmt.Errorf("PKI payload too short (%v bytes)", len(encrypted))
+	}
+	secret, err := privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey := sha256.Sum256(secret)
+	block, err := aes.NewCipher(sharedKey[:])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := encrypted[:len(encrypted)-pkiOverhead]
+	tag := encrypted[len(encrypted)-pkiOverhead : len(encrypted)-4]
+	extraNonce := encrypted[len(encrypted)-4:]
+	nonce := make([]byte, 16)
+	binary.LittleEndian.PutUint64(nonce[0:], uint64(packetId))
+	binary.LittleEndian.PutUint32(nonce[8:], from)
+	if binary.LittleEndian.Uint32(extraNonce) != 0 {
+		copy(nonce[4:], extraNonce)
+	}
+	decrypted, err := ccmDecrypt(block, nonce[:pkiNonceSize], ciphertext, tag)
+	if err != nil {
+		return nil, err
+	}
+	data := new(generated.Data)
+	if err := proto.Unmarshal(decrypted, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ccmDecrypt implements AES-CCM (RFC 3610) decryption without associated
+// data, with a 2-byte length field and len(tag) byte auth tag.
+func ccmDecrypt(block cipher.Block, nonce, ciphertext, tag []byte) ([]byte, error) {
+	const l = 2
+	if len(nonce) != 15-l || len(ciphertext) >= 1<<(8*l) {
+		return nil, errors.New("invalid CCM parameters")
+	}
+	// counter blocks: flags | nonce | counter, counter 0 encrypts the tag
+	var ctr [aes.BlockSize]byte
+	ctr[0] = l - 1
+	copy(ctr[1:], nonce)
+	var s0 [aes.BlockSize]byte
+	block.Encrypt(s0[:], ctr[:])
+	ctr[aes.BlockSize-1] = 1
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, ctr[:]).XORKeyStream(plaintext, ciphertext)
+	// CBC-MAC over B0 | plaintext
+	var x [aes.BlockSize]byte
+	x[0] = byte(((len(tag)-2)/2)<<3 | (l - 1))
+	copy(x[1:], nonce)
+	binary.BigEndian.PutUint16(x[aes.BlockSize-l:], uint16(len(plaintext)))
+	block.Encrypt(x[:], x[:])
+	for i := 0; i < len(plaintext); i += aes.BlockSize {
+		subtle.XORBytes(x[:], x[:], plaintext[i:min(i+aes.BlockSize, len(plaintext))])
+		block.Encrypt(x[:], x[:])
+	}
+	expected := make([]byte, len(tag))
+	subtle.XORBytes(expected, x[:len(tag)], s0[:len(tag)])
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, ErrPKIAuth
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,121 @@
+package meshtastic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The vectors below were encrypted with OpenSSL's AES-CCM (M=8, L=2) and
+// X25519, independent of this package.
+
+// the key, nonce and payload of RFC 3610 packet vector #1, without its header
+// as associated data, which leaves the ciphertext the same but not the tag
+func TestCCMDecrypt(t *testing.T) {
+	block := NewBlockCipher(unhex(t, "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf"))
+	nonce := unhex(t, "00000003020100a0a1a2a3a4a5")
+	ciphertext := unhex(t, "588c979a61c663d2f066d0c2c0f989806d5f6b61dac384")
+	tag := unhex(t, "7c2051a7ae200bcf")
+	expected := unhex(t, "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e")
+	plaintext, err := ccmDecrypt(block, nonce, ciphertext, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, expected) {
+		t.Errorf("got %x, want %x", plaintext, expected)
+	}
+	for i := range len(tag) * 8 {
+		wrongTag := bytes.Clone(tag)
+		wrongTag[i/8] ^= 0x80 >> (i % 8)
+		if _, err := ccmDecrypt(block, nonce, ciphertext, wrongTag); !errors.Is(err, ErrPKIAuth) {
+			t.Errorf("tag bit %v flipped: got %v, want %v", i, err, ErrPKIAuth)
+		}
+	}
+	for i := range ciphertext {
+		wrongCiphertext := bytes.Clone(ciphertext)
+		wrongCiphertext[i] ^= 0x01
+		if _, err := ccmDecrypt(block, nonce, wrongCiphertext, tag); !errors.Is(err, ErrPKIAuth) {
+			t.Errorf("ciphertext byte %v changed: got %v, want %v", i, err, ErrPKIAuth)
+		}
+	}
+	if _, err := ccmDecrypt(block, nonce[1:], ciphertext, tag); err == nil {
+		t.Error("short nonce: no error")
+	}
+}
+
+// RFC 7748 section 6.1 keys: Alice is our node, Bob sends her a direct message
+// with packet id 0x0a0b0c0d and extra nonce 0x11223344.
+const (
+	pkiAlicePrivate = "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"
+	pkiBobPublic    = "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"
+	pkiAliceNum     = 0x0000a11c
+	pkiBobNum       = 0xdeadbeef
+	pkiPacketId     = 0x0a0b0c0d
+	// ciphertext | tag | extra nonce
+	pkiEncrypted = "9ff4e752caea8b20b5" + "2ba5081170a833fb" + "44332211"
+)
+
+func TestPKIKeyringDecrypt(t *testing.T) {
+	var keyring PKIKeyring
+	if err := keyring.Parse("!0000a11c=" + base64.StdEncoding.EncodeToString(unhex(t, pkiAlicePrivate))); err != nil {
+		t.Fatal(err)
+	}
+	if !keyring.Has(pkiAliceNum) {
+		t.Fatal("no key for Alice")
+	}
+	senderKey := unhex(t, pkiBobPublic)
+	encrypted := unhex(t, pkiEncrypted)
+	data, err := keyring.Decrypt(pkiBobNum, pkiAliceNum, pkiPacketId, senderKey, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &generated.Data{Portnum: generated.PortNum_TEXT_MESSAGE_APP, Payload: []byte("hello")}
+	if !proto.Equal(data, expected) {
+		t.Errorf("got %v, want %v", data, expected)
+	}
+
+	wrongTag := bytes.Clone(encrypted)
+	wrongTag[len(wrongTag)-pkiOverhead] ^= 0x01
+	if _, err := keyring.Decrypt(pkiBobNum, pkiAliceNum, pkiPacketId, senderKey, wrongTag); !errors.Is(err, ErrPKIAuth) {
+		t.Errorf("wrong tag: got %v, want %v", err, ErrPKIAuth)
+	}
+	wrongNonce := bytes.Clone(encrypted)
+	wrongNonce[len(wrongNonce)-1] ^= 0x01
+	if _, err := keyring.Decrypt(pkiBobNum, pkiAliceNum, pkiPacketId, senderKey, wrongNonce); !errors.Is(err, ErrPKIAuth) {
+		t.Errorf("wrong extra nonce: got %v, want %v", err, ErrPKIAuth)
+	}
+	if _, err := keyring.Decrypt(pkiBobNum, pkiAliceNum, pkiPacketId+1, senderKey, encrypted); !errors.Is(err, ErrPKIAuth) {
+		t.Errorf("wrong packet id: got %v, want %v", err, ErrPKIAuth)
+	}
+	if _, err := keyring.Decrypt(pkiBobNum+1, pkiAliceNum, pkiPacketId, senderKey, encrypted); !errors.Is(err, ErrPKIAuth) {
+		t.Errorf("wrong sender: got %v, want %v", err, ErrPKIAuth)
+	}
+	otherKey := bytes.Clone(senderKey)
+	otherKey[0] ^= 0x01
+	if _, err := keyring.Decrypt(pkiBobNum, pkiAliceNum, pkiPacketId, otherKey, encrypted); !errors.Is(err, ErrPKIAuth) {
+		t.Errorf("wrong sender key: got %v, want %v", err, ErrPKIAuth)
+	}
+	if _, err := keyring.Decrypt(pkiBobNum, pkiAliceNum, pkiPacketId, nil, encrypted); !errors.Is(err, ErrNoPublicKey) {
+		t.Errorf("no sender key: got %v, want %v", err, ErrNoPublicKey)
+	}
+	if _, err := keyring.Decrypt(pkiBobNum, pkiBobNum, pkiPacketId, senderKey, encrypted); !errors.Is(err, ErrNoPrivateKey) {
+		t.Errorf("not ours: got %v, want %v", err, ErrNoPrivateKey)
+	}
+	if _, err := keyring.Decrypt(pkiBobNum, pkiAliceNum, pkiPacketId, senderKey, encrypted[:pkiOverhead-1]); err == nil {
+		t.Error("too short: no error")
+	}
+}
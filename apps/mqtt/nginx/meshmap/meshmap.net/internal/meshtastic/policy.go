@@ -0,0 +1,250 @@
+package meshtastic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reasons packets are dropped by Policy
+const (
+	DropBlocked     = "blocked"
+	DropNodeRate    = "nodeRate"
+	DropTopicRate   = "topicRate"
+	DropGatewayRate = "gatewayRate"
+)
+
+// NodeSet is a set of node numbers.
+type NodeSet map[uint32]struct{}
+
+// LoadNodeSet reads a file with one node number or !id per line.
+// Blank lines and anything after a # are ignored.
+func LoadNodeSet(path string) (NodeSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	nodes := make(NodeSet)
+	return nodes, nodes.parse(f)
+}
+
+func (nodes NodeSet) parse(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		nodeNum, err := ParseNodeNum(line)
+		if err != nil {
+			return err
+		}
+		nodes[nodeNum] = struct{}{}
+	}
+	return s.Err()
+}
+
+// WriteFile writes the set in the format read by LoadNodeSet.
+func (nodes NodeSet) WriteFile(path string) error {
+	return writeFile(path, 0644, func(w io.Writer) error {
+		for nodeNum := range nodes {
+			if _, err := fmt.Fprintln(w, nodeNum); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NodeSetFile is a NodeSet file that is reloaded when it changes.
+type NodeSetFile struct {
+	Path    string
+	modTime time.Time
+}
+
+// Reload reads the file if it was modified since the last load, or if force is set.
+func (f *NodeSetFile) Reload(force bool) (NodeSet, bool, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !force && info.ModTime().Equal(f.modTime) {
+		return nil, false, nil
+	}
+	nodes, err := LoadNodeSet(f.Path)
+	if err != nil {
+		return nil, false, err
+	}
+	f.modTime = info.ModTime()
+	return nodes, true, nil
+}
+
+// Rate is a token bucket limit of Count packets per Per, allowing bursts of Count.
+// A zero Count disables the limit.
+type Rate struct {
+	Count float64
+	Per   time.Duration
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *bucket) take(rate Rate, now time.Time) bool {
+	b.tokens += now.Sub(b.updated).Seconds() * rate.Count / rate.Per.Seconds()
+	b.tokens = min(b.tokens, rate.Count)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func take[K comparable](buckets map[K]*bucket, key K, rate Rate, now time.Time) bool {
+	if rate.Count == 0 {
+		return true
+	}
+	b := buckets[key]
+	if b == nil {
+		b = &bucket{tokens: rate.Count, updated: now}
+		buckets[key] = b
+	}
+	return b.take(rate, now)
+}
+
+func pruneBuckets[K comparable](buckets map[K]*bucket, rate Rate, now time.Time) {
+	for key, b := range buckets {
+		// a bucket that has refilled is the same as a new one
+		if now.Sub(b.updated) > rate.Per {
+			delete(buckets, key)
+		}
+	}
+}
+
+// Policy decides which packets are admitted, based on node block and allow
+// lists and token bucket rate limits per node, topic and gateway.
+// Allowed nodes bypass both the blocklist and the rate limits.
+type Policy struct {
+	NodeRate    Rate
+	TopicRate   Rate // per topic without the gateway, i.e. per root and channel
+	GatewayRate Rate
+	mu          sync.Mutex
+	blocked     map[string]NodeSet // by source
+	allowed     NodeSet
+	nodes       map[uint32]*bucket
+	topics      map[string]*bucket
+	gateways    map[string]*bucket
+	drops       map[string]uint64
+	nodeDrops   map[uint32]uint64
+}
+
+func NewPolicy(nodeRate, topicRate, gatewayRate Rate) *Policy {
+	return &Policy{
+		NodeRate:    nodeRate,
+		TopicRate:   topicRate,
+		GatewayRate: gatewayRate,
+		blocked:     make(map[string]NodeSet),
+		nodes:       make(map[uint32]*bucket),
+		topics:      make(map[string]*bucket),
+		gateways:    make(map[string]*bucket),
+		drops:       make(map[string]uint64),
+		nodeDrops:   make(map[uint32]uint64),
+	}
+}
+
+// SetBlocked replaces the blocklist from source. Blocklists from all sources apply.
+func (p *Policy) SetBlocked(source string, nodes NodeSet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blocked[source] = nodes
+}
+
+// SetAllowed replaces the allowlist.
+func (p *Policy) SetAllowed(nodes NodeSet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allowed = nodes
+}
+
+// Accept reports whether a copy of a packet from a node received as rx is
+// admitted, counting it against the topic and gateway rates.
+func (p *Policy) Accept(from uint32, rx *Reception) bool {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, found := p.allowed[from]; found {
+		return true
+	}
+	for _, blocked := range p.blocked {
+		if _, found := blocked[from]; found {
+			return p.drop(from, DropBlocked)
+		}
+	}
+	topic := strings.TrimSuffix(rx.Topic, "/"+rx.Gateway)
+	if !take(p.topics, topic, p.TopicRate, now) {
+		return p.drop(from, DropTopicRate)
+	}
+	if len(rx.Gateway) > 0 && !take(p.gateways, rx.Gateway, p.GatewayRate, now) {
+		return p.drop(from, DropGatewayRate)
+	}
+	return true
+}
+
+// AcceptPacket reports whether a new packet from a node is admitted, counting
+// it against the node rate once however many gateways heard it.
+func (p *Policy) AcceptPacket(from uint32) bool {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, found := p.allowed[from]; found {
+		return true
+	}
+	if !take(p.nodes, from, p.NodeRate, now) {
+		return p.drop(from, DropNodeRate)
+	}
+	return true
+}
+
+func (p *Policy) drop(from uint32, reason string) bool {
+	p.drops[reason]++
+	p.nodeDrops[from]++
+	return false
+}
+
+// Drops returns the number of dropped packets by reason.
+func (p *Policy) Drops() map[string]uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	drops := make(map[string]uint64, len(p.drops))
+	for reason, count := range p.drops {
+		drops[reason] = count
+	}
+	return drops
+}
+
+// TakeNodeDrops returns and resets the number of dropped packets by node.
+func (p *Policy) TakeNodeDrops() map[uint32]uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	nodeDrops := p.nodeDrops
+	p.nodeDrops = make(map[uint32]uint64)
+	return nodeDrops
+}
+
+// Prune forgets rate limit state that has expired.
+func (p *Policy) Prune() {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pruneBuckets(p.nodes, p.NodeRate, now)
+	pruneBuckets(p.topics, p.TopicRate, now)
+	pruneBuckets(p.gateways, p.GatewayRate, now)
+}
@@ -0,0 +1,73 @@
+package meshtastic
+
+import (
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+)
+
+// thresholds of a poor fix
+const (
+	PoorFixPdop = 5
+	PoorFixSats = 4
+	PoorFixAge  = 10 * 60 // s
+	// fix ages beyond this come from an unset node clock and are ignored
+	maxFixAge = 24 * 60 * 60
+)
+
+// NMEA GGA fix qualities
+const (
+	fixQualityEstimated  = 6
+	fixQualityManual     = 7
+	fixQualitySimulation = 8
+)
+
+// PositionFix is how a position was obtained and where the node was headed,
+// from the Position fields besides the coordinates. Map reports don't have it.
+type PositionFix struct {
+	Time           int64   `json:"time,omitempty"`        // node clock when sent
+	Timestamp      int64   `json:"timestamp,omitempty"`   // of the GPS solution
+	FixAge         int64   `json:"fixAge,omitempty"`      // s from Timestamp (or Time) to reception
+	GroundSpeed    *uint32 `json:"groundSpeed,omitempty"` // m/s
+	GroundTrack    float32 `json:"groundTrack,omitempty"` // degrees from true north, direction of travel
+	SatsInView     uint32  `json:"satsInView,omitempty"`
+	Pdop           float32 `json:"pdop,omitempty"`
+	FixQuality     uint32  `json:"fixQuality,omitempty"` // NMEA GGA
+	LocationSource string  `json:"locationSource,omitempty"`
+	ManualFix      bool    `json:"manualFix,omitempty"`
+	PoorFix        bool    `json:"poorFix,omitempty"`
+}
+
+// NewPositionFix reads the fix details of a position received at received.
+func NewPositionFix(position *generated.Position, received int64) *PositionFix {
+	fix := &PositionFix{
+		Time:       int64(position.GetTime()),
+		Timestamp:  int64(position.GetTimestamp()),
+		SatsInView: position.GetSatsInView(),
+		Pdop:       float32(position.GetPDOP()) / 100,
+		FixQuality: position.GetFixQuality(),
+	}
+	if position.GroundSpeed != nil {
+		speed := position.GetGroundSpeed()
+		fix.GroundSpeed = &speed
+	}
+	// 1/100 degrees by the protobuf docs, but the firmware sends 1e-5 degrees
+	fix.GroundTrack = float32(position.GetGroundTrack()) / 1e5
+	if source := position.GetLocationSource(); source != generated.Position_LOC_UNSET {
+		fix.LocationSource = source.String()
+	}
+	fixTime := fix.Timestamp
+	if fixTime == 0 {
+		fixTime = fix.Time
+	}
+	if fixTime > 0 {
+		if age := received - fixTime; age <= maxFixAge {
+			fix.FixAge = max(age, 0)
+		}
+	}
+	fix.ManualFix = position.GetLocationSource() == generated.Position_LOC_MANUAL || fix.FixQuality == fixQualityManual
+	fix.PoorFix = fix.FixQuality == fixQualityEstimated ||
+		fix.FixQuality == fixQualitySimulation ||
+		fix.Pdop > PoorFixPdop ||
+		(fix.SatsInView > 0 && fix.SatsInView < PoorFixSats) ||
+		fix.FixAge > PoorFixAge
+	return fix
+}
@@ -0,0 +1,210 @@
+package meshtastic
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	// a sender's range test session ends after this long without packets
+	RangeTestSessionTimeout = 30 * 60
+	RangeTestSeqLimit       = 5000 // per session
+)
+
+// ParseRangeTestSeq parses the "seq N" payload of range test packets.
+func ParseRangeTestSeq(payload []byte) (uint32, bool) {
+	var seq uint32
+	if _, err := fmt.Sscanf(string(payload), "seq %d", &seq); err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+type rangeTestReception struct {
+	gateway string
+	snr     float32
+	rssi    int32
+}
+
+// a range test packet, with where the sender was when sending it, if known
+type rangeTestSeq struct {
+	latitude   int32
+	longitude  int32
+	receptions []rangeTestReception
+}
+
+type rangeTestSession struct {
+	from     uint32
+	start    int64
+	updated  int64
+	firstSeq uint32
+	lastSeq  uint32
+	seqs     map[uint32]*rangeTestSeq
+}
+
+// RangeTestLog detects the range test sessions of senders and collects
+// every reception of their packets.
+type RangeTestLog struct {
+	sessions []*rangeTestSession
+	current  map[uint32]*rangeTestSession // by sender
+}
+
+func NewRangeTestLog() *RangeTestLog {
+	return &RangeTestLog{current: make(map[uint32]*rangeTestSession)}
+}
+
+// Add records a reception of range test packet seq from a node, which was at
+// latitude, longitude (zero if unknown). A new session starts when the sequence
+// starts over or the sender was quiet for RangeTestSessionTimeout.
+func (l *RangeTestLog) Add(from, seq uint32, rx *Reception, latitude, longitude int32) {
+	now := rx.RxTime
+	session := l.current[from]
+	if session == nil || seq < session.firstSeq || session.updated+RangeTestSessionTimeout < now {
+		session = &rangeTestSession{
+			from:     from,
+			start:    now,
+			firstSeq: seq,
+			lastSeq:  seq,
+			seqs:     make(map[uint32]*rangeTestSeq),
+		}
+		l.current[from] = session
+		l.sessions = append(l.sessions, session)
+	}
+	session.updated = max(session.updated, now)
+	s := session.seqs[seq]
+	if s == nil {
+		if len(session.seqs) >= RangeTestSeqLimit {
+			return
+		}
+		s = &rangeTestSeq{latitude: latitude, longitude: longitude}
+		session.seqs[seq] = s
+	}
+	// a sender uplinking its own packets says nothing about range
+	if rx.Gateway != NodeId(from) && len(s.receptions) < ReceptionLimit {
+		s.receptions = append(s.receptions, rangeTestReception{
+			gateway: rx.Gateway,
+			snr:     cleanFloat(rx.RxSnr),
+			rssi:    rx.RxRssi,
+		})
+	}
+	session.lastSeq = max(session.lastSeq, seq)
+}
+
+// Prune removes sessions that ended more than ttl ago.
+func (l *RangeTestLog) Prune(ttl int64) {
+	now := time.Now().Unix()
+	l.sessions = slices.DeleteFunc(l.sessions, func(session *rangeTestSession) bool {
+		if session.updated+ttl >= now {
+			return false
+		}
+		if l.current[session.from] == session {
+			delete(l.current, session.from)
+		}
+		return true
+	})
+}
+
+// RangeTestBin is the packets of a session sent within a distance band of a
+// gateway. Only packets heard by some gateway (or uplinked by the sender
+// itself) count as sent, the sender position is unknown for the others.
+type RangeTestBin struct {
+	Distance float64 `json:"distance"` // lower bound, m
+	Sent     uint32  `json:"sent"`
+	Heard    uint32  `json:"heard"`
+	Loss     float32 `json:"loss"`
+	Snr      float32 `json:"snr,omitempty"` // average of heard packets
+	Rssi     float32 `json:"rssi,omitempty"`
+}
+
+// RangeTestGateway is how a gateway heard a session, by distance from the sender.
+type RangeTestGateway struct {
+	Heard uint32          `json:"heard"`
+	Bins  []*RangeTestBin `json:"bins,omitempty"` // if the gateway position is known
+}
+
+// RangeTestReport is the packet loss of a session, overall and by gateway.
+type RangeTestReport struct {
+	From     uint32                       `json:"from"`
+	Start    int64                        `json:"start"`
+	Updated  int64                        `json:"updated"`
+	FirstSeq uint32                       `json:"firstSeq"`
+	LastSeq  uint32                       `json:"lastSeq"`
+	Sent     uint32                       `json:"sent"` // judging by the sequence numbers
+	Heard    uint32                       `json:"heard"`
+	Loss     float32                      `json:"loss"`
+	Gateways map[string]*RangeTestGateway `json:"gateways"`
+}
+
+// Report returns loss-vs-distance and SNR-vs-distance reports of the sessions,
+// in binSize m distance bands. Positions of gateways are looked up in db.
+func (l *RangeTestLog) Report(db NodeDB, binSize float64) []*RangeTestReport {
+	reports := make([]*RangeTestReport, 0, len(l.sessions))
+	for _, session := range l.sessions {
+		report := &RangeTestReport{
+			From:     session.from,
+			Start:    session.start,
+			Updated:  session.updated,
+			FirstSeq: session.firstSeq,
+			LastSeq:  session.lastSeq,
+			Sent:     session.lastSeq - session.firstSeq + 1,
+			Heard:    uint32(len(session.seqs)),
+			Gateways: make(map[string]*RangeTestGateway),
+		}
+		report.Loss = 1 - float32(report.Heard)/float32(report.Sent)
+		// gateways that heard anything
+		for _, s := range session.seqs {
+			for _, rx := range s.receptions {
+				if report.Gateways[rx.gateway] == nil {
+					report.Gateways[rx.gateway] = new(RangeTestGateway)
+				}
+			}
+		}
+		for gateway, gw := range report.Gateways {
+			var gatewayNode *Node
+			if nodeNum, err := ParseNodeNum(gateway); err == nil {
+				gatewayNode = db[nodeNum]
+			}
+			hasPosition := gatewayNode != nil && (gatewayNode.Latitude != 0 || gatewayNode.Longitude != 0)
+			bins := make(map[int]*RangeTestBin)
+			for _, s := range session.seqs {
+				var heard *rangeTestReception
+				for i := range s.receptions {
+					if s.receptions[i].gateway == gateway {
+						heard = &s.receptions[i]
+						break
+					}
+				}
+				if heard != nil {
+					gw.Heard++
+				}
+				if !hasPosition || (s.latitude == 0 && s.longitude == 0) {
+					continue
+				}
+				distance := Distance(s.latitude, s.longitude, gatewayNode.Latitude, gatewayNode.Longitude)
+				index := int(distance / binSize)
+				bin := bins[index]
+				if bin == nil {
+					bin = &RangeTestBin{Distance: float64(index) * binSize}
+					bins[index] = bin
+				}
+				bin.Sent++
+				if heard != nil {
+					bin.Snr = (bin.Snr*float32(bin.Heard) + heard.snr) / float32(bin.Heard+1)
+					bin.Rssi = (bin.Rssi*float32(bin.Heard) + float32(heard.rssi)) / float32(bin.Heard+1)
+					bin.Heard++
+				}
+			}
+			for _, bin := range bins {
+				bin.Loss = 1 - float32(bin.Heard)/float32(bin.Sent)
+				gw.Bins = append(gw.Bins, bin)
+			}
+			slices.SortFunc(gw.Bins, func(a, b *RangeTestBin) int {
+				return cmp.Compare(a.Distance, b.Distance)
+			})
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
@@ -0,0 +1,125 @@
+package meshtastic
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	RouteLimit = 500
+	// hops the firmware could not identify
+	unknownNode = 0xffffffff
+	unknownSnr  = -128
+)
+
+// RouteHop is a link seen in traceroutes, stored on the receiving node.
+type RouteHop struct {
+	Snr     float32 `json:"snr"` // moving average
+	Count   uint32  `json:"count"`
+	Updated int64   `json:"updated"`
+}
+
+// Route is a traceroute reply: the path from the requester to the
+// destination and, as far as it got, the path back.
+type Route struct {
+	From       uint32    `json:"from"` // requester
+	To         uint32    `json:"to"`   // destination
+	Forward    []uint32  `json:"forward"`
+	SnrTowards []float32 `json:"snrTowards"`
+	Back       []uint32  `json:"back"`
+	SnrBack    []float32 `json:"snrBack"`
+	Time       int64     `json:"time"`
+}
+
+func NewRoute(from, to uint32, route []uint32, snrTowards []int32, routeBack []uint32, snrBack []int32, received int64) *Route {
+	convert := func(snrs []int32) []float32 {
+		converted := make([]float32, len(snrs))
+		for i, snr := range snrs {
+			converted[i] = float32(snr) / 4
+			if snr == unknownSnr {
+				converted[i] = unknownSnr
+			}
+		}
+		return converted
+	}
+	return &Route{
+		From:       from,
+		To:         to,
+		Forward:    append(append([]uint32{from}, route...), to),
+		SnrTowards: convert(snrTowards),
+		Back:       append(append([]uint32{to}, routeBack...), from),
+		SnrBack:    convert(snrBack),
+		Time:       received,
+	}
+}
+
+// RouteEdge is a directed link from a transmitting to a receiving node.
+type RouteEdge struct {
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+	*RouteHop
+}
+
+// Edges returns the links of the route with a known SNR. The path back may
+// be incomplete if the reply was uplinked before reaching the requester.
+func (route *Route) Edges() []RouteEdge {
+	var edges []RouteEdge
+	for _, path := range []struct {
+		nodes []uint32
+		snrs  []float32
+	}{
+		{route.Forward, route.SnrTowards},
+		{route.Back, route.SnrBack},
+	} {
+		for i, snr := range path.snrs {
+			if i+1 >= len(path.nodes) {
+				break
+			}
+			from, to := path.nodes[i], path.nodes[i+1]
+			if from == unknownNode || to == unknownNode || snr == unknownSnr {
+				continue
+			}
+			edges = append(edges, RouteEdge{From: from, To: to, RouteHop: &RouteHop{Snr: snr}})
+		}
+	}
+	return edges
+}
+
+// RouteLog keeps the most recent routes.
+type RouteLog []*Route
+
+// Add inserts route in time order, so replayed routes don't hold back Prune.
+func (routes *RouteLog) Add(route *Route) {
+	i := len(*routes)
+	for i > 0 && (*routes)[i-1].Time > route.Time {
+		i--
+	}
+	*routes = slices.Insert(*routes, i, route)
+	if len(*routes) > RouteLimit {
+		*routes = (*routes)[len(*routes)-RouteLimit:]
+	}
+}
+
+func (routes *RouteLog) Prune(ttl int64) {
+	now := time.Now().Unix()
+	for len(*routes) > 0 && (*routes)[0].Time+ttl < now {
+		*routes = (*routes)[1:]
+	}
+}
+
+// RouteGraph is the route graph of a NodeDB along with the routes it was built from.
+type RouteGraph struct {
+	Edges  []RouteEdge `json:"edges"`
+	Routes RouteLog    `json:"routes"`
+}
+
+func (db NodeDB) GetRouteGraph(routes RouteLog) *RouteGraph {
+	graph := &RouteGraph{Edges: []RouteEdge{}, Routes: RouteLog{}}
+	graph.Routes = append(graph.Routes, routes...)
+	for nodeNum, node := range db {
+		for hopNum, hop := range node.RouteHops {
+			graph.Edges = append(graph.Edges, RouteEdge{From: hopNum, To: nodeNum, RouteHop: hop})
+		}
+	}
+	return graph
+}
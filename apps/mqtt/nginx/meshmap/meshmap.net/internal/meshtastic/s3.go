@@ -0,0 +1,241 @@
+package meshtastic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3NodeSet is a node blocklist kept as objects under a prefix of an
+// S3-compatible bucket, as shared with the meshtk MQTT proxy. Each object is
+// named after a node number or !id, or else contains one per line.
+type S3NodeSet struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com or a local stand-in
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyId     string // anonymous requests if empty
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// S3NodeSetFromEnv configures the blocklist from the meshtk proxy's
+// MESHTK_SERVER_S3BUCKET* variables and the standard AWS credentials.
+// MESHTK_SERVER_S3ENDPOINT overrides the AWS endpoint for other S3 services.
+func S3NodeSetFromEnv() (*S3NodeSet, bool) {
+	if os.Getenv("MESHTK_SERVER_USES3BUCKET") != "true" {
+		return nil, false
+	}
+	s := &S3NodeSet{
+		Endpoint:        os.Getenv("MESHTK_SERVER_S3ENDPOINT"),
+		Region:          os.Getenv("MESHTK_SERVER_S3BUCKETREGION"),
+		Bucket:          os.Getenv("MESHTK_SERVER_S3BUCKETNAME"),
+		Prefix:          os.Getenv("MESHTK_SERVER_S3BUCKETPREFIX"),
+		AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if len(s.Region) == 0 {
+		s.Region = os.Getenv("AWS_REGION")
+	}
+	if len(s.Region) == 0 {
+		s.Region = "us-east-1"
+	}
+	if len(s.Endpoint) == 0 {
+		s.Endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", s.Region)
+	}
+	return s, len(s.Bucket) > 0
+}
+
+// Fetch lists the blocklist objects and returns the blocked nodes.
+func (s *S3NodeSet) Fetch(ctx context.Context) (NodeSet, error) {
+	nodes := make(NodeSet)
+	var continuationToken string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+		if len(continuationToken) > 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+		body, err := s.get(ctx, "", query)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, fmt.Errorf("parse object list: %w", err)
+		}
+		for _, object := range result.Contents {
+			name := path.Base(object.Key)
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			if nodeNum, err := ParseNodeNum(strings.TrimSuffix(name, path.Ext(name))); err == nil {
+				nodes[nodeNum] = struct{}{}
+				continue
+			}
+			body, err := s.get(ctx, object.Key, nil)
+			if err != nil {
+				return nil, err
+			}
+			// a bad object is skipped as a whole rather than failing the fetch
+			objectNodes := make(NodeSet)
+			if err := objectNodes.parse(bytes.NewReader(body)); err != nil {
+				log.Printf("[warn] skipping S3 blocklist object %v: %v", object.Key, err)
+				continue
+			}
+			for nodeNum := range objectNodes {
+				nodes[nodeNum] = struct{}{}
+			}
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return nodes, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// get requests an object, or the bucket itself if key is empty, using path-style URLs.
+func (s *S3NodeSet) get(ctx context.Context, key string, query url.Values) ([]byte, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.Bucket
+	if len(key) > 0 {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.AccessKeyId) > 0 {
+		s.sign(req, time.Now().UTC())
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %v: %v", u.Path, resp.Status)
+	}
+	return body, nil
+}
+
+// sign adds an AWS Signature Version 4 to a bodiless request.
+func (s *S3NodeSet) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", now.Format("20060102"), s.Region)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptySHA256)
+	if len(s.SessionToken) > 0 {
+		req.Header.Set("x-amz-security-token", s.SessionToken)
+	}
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if len(s.SessionToken) > 0 {
+		headers = append(headers, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, header := range headers {
+		value := req.Header.Get(header)
+		if header == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%v:%v\n", header, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%x",
+		s.AccessKeyId, scope, signedHeaders, hmacSHA256(key, stringToSign),
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string sorted by key, as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but RFC 3986 unreserved characters,
+// and slashes unless encodeSlash is set, as SigV4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package meshtastic
+
+import (
+	"time"
+)
+
+// the firmware's default heartbeat period, for routers that haven't sent one
+const defaultHeartbeatPeriod = 900
+
+// StoreForward is what a Store & Forward router has announced about itself.
+type StoreForward struct {
+	// Heartbeat
+	Period        uint32 `json:"period,omitempty"` // seconds between heartbeats
+	Secondary     bool   `json:"secondary,omitempty"`
+	LastHeartbeat int64  `json:"lastHeartbeat,omitempty"`
+	// Statistics
+	MessagesTotal   uint32 `json:"messagesTotal,omitempty"`
+	MessagesSaved   uint32 `json:"messagesSaved,omitempty"`
+	MessagesMax     uint32 `json:"messagesMax,omitempty"`
+	Uptime          uint32 `json:"uptime,omitempty"`
+	Requests        uint32 `json:"requests,omitempty"`
+	RequestsHistory uint32 `json:"requestsHistory,omitempty"`
+	ReturnMax       uint32 `json:"returnMax,omitempty"`
+	ReturnWindow    uint32 `json:"returnWindow,omitempty"` // minutes
+	LastStats       int64  `json:"lastStats,omitempty"`
+	// History, replies to clients asking for stored messages
+	HistoryReturns          uint32 `json:"historyReturns,omitempty"`
+	HistoryMessagesReturned uint32 `json:"historyMessagesReturned,omitempty"`
+	LastHistory             int64  `json:"lastHistory,omitempty"`
+	// any router message
+	Updated int64 `json:"updated"`
+}
+
+func (sf *StoreForward) UpdateHeartbeat(period, secondary uint32, updated int64) {
+	if updated < sf.LastHeartbeat {
+		return
+	}
+	sf.Period = period
+	sf.Secondary = secondary != 0
+	sf.LastHeartbeat = updated
+}
+
+func (sf *StoreForward) UpdateStats(messagesTotal, messagesSaved, messagesMax, uptime, requests, requestsHistory, returnMax, returnWindow uint32, updated int64) {
+	if updated < sf.LastStats {
+		return
+	}
+	sf.MessagesTotal = messagesTotal
+	sf.MessagesSaved = messagesSaved
+	sf.MessagesMax = messagesMax
+	sf.Uptime = uptime
+	sf.Requests = requests
+	sf.RequestsHistory = requestsHistory
+	sf.ReturnMax = returnMax
+	sf.ReturnWindow = returnWindow
+	sf.LastStats = updated
+}
+
+// UpdateHistory counts a history reply, replayed ones included.
+func (sf *StoreForward) UpdateHistory(messages uint32, updated int64) {
+	sf.HistoryReturns++
+	sf.HistoryMessagesReturned += messages
+	sf.LastHistory = max(sf.LastHistory, updated)
+}
+
+// IsActive reports whether the router was heard from within three heartbeat periods.
+func (sf *StoreForward) IsActive(now int64) bool {
+	period := int64(sf.Period)
+	if period == 0 {
+		period = defaultHeartbeatPeriod
+	}
+	return sf.Updated+3*period >= now
+}
+
+// StoreForwardServer is an active Store & Forward router.
+type StoreForwardServer struct {
+	NodeNum   uint32 `json:"nodeNum"`
+	LongName  string `json:"longName,omitempty"`
+	ShortName string `json:"shortName,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	Latitude  int32  `json:"latitude,omitempty"`
+	Longitude int32  `json:"longitude,omitempty"`
+	*StoreForward
+}
+
+func (db NodeDB) GetStoreForwardServers() []StoreForwardServer {
+	now := time.Now().Unix()
+	servers := []StoreForwardServer{}
+	for nodeNum, node := range db {
+		if node.StoreForward == nil || !node.StoreForward.IsActive(now) {
+			continue
+		}
+		servers = append(servers, StoreForwardServer{
+			NodeNum:      nodeNum,
+			LongName:     node.LongName,
+			ShortName:    node.ShortName,
+			Channel:      node.Channel,
+			Latitude:     node.Latitude,
+			Longitude:    node.Longitude,
+			StoreForward: node.StoreForward,
+		})
+	}
+	return servers
+}
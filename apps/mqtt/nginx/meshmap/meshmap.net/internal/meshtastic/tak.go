@@ -0,0 +1,255 @@
+package meshtastic
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const TakChatLimit = 100
+
+// TakEntity is an ATAK user reporting through a Meshtastic node.
+type TakEntity struct {
+	Callsign       string `json:"callsign"`
+	DeviceCallsign string `json:"deviceCallsign,omitempty"` // the ATAK UID
+	Team           string `json:"team,omitempty"`
+	Role           string `json:"role,omitempty"`
+	Battery        uint32 `json:"battery,omitempty"`
+	// PLI
+	Latitude  int32  `json:"latitude"`
+	Longitude int32  `json:"longitude"`
+	Altitude  int32  `json:"altitude,omitempty"`
+	Speed     uint32 `json:"speed,omitempty"`  // m/s
+	Course    uint32 `json:"course,omitempty"` // degrees
+	LastPli   int64  `json:"lastPli,omitempty"`
+	Updated   int64  `json:"updated"`
+}
+
+// Uid returns the ATAK UID of the entity, made up from the node number if unknown.
+func (entity *TakEntity) Uid(nodeNum uint32) string {
+	if len(entity.DeviceCallsign) > 0 {
+		return entity.DeviceCallsign
+	}
+	return "MESHTASTIC-" + NodeId(nodeNum)
+}
+
+// TakChat is a GeoChat message sent to a chat room.
+type TakChat struct {
+	From       uint32 `json:"from"`
+	Callsign   string `json:"callsign"`
+	To         string `json:"to,omitempty"`
+	ToCallsign string `json:"toCallsign,omitempty"`
+	Message    string `json:"message"`
+	Time       int64  `json:"time"`
+}
+
+// TakDB holds the ATAK entities by node number and their recent GeoChat messages.
+type TakDB struct {
+	Entities map[uint32]*TakEntity `json:"entities"`
+	Chats    []*TakChat            `json:"chats"`
+}
+
+func NewTakDB() *TakDB {
+	return &TakDB{
+		Entities: make(map[uint32]*TakEntity),
+		Chats:    []*TakChat{},
+	}
+}
+
+// teamName is the ATAK name of a team color.
+func teamName(team generated.Team) string {
+	if team == generated.Team_Unspecifed_Color {
+		return ""
+	}
+	return strings.ReplaceAll(team.String(), "_", " ")
+}
+
+// roleName is the ATAK name of a team role.
+func roleName(role generated.MemberRole) string {
+	switch role {
+	case generated.MemberRole_Unspecifed:
+		return ""
+	case generated.MemberRole_TeamMember:
+		return "Team Member"
+	case generated.MemberRole_TeamLead:
+		return "Team Lead"
+	case generated.MemberRole_ForwardObserver:
+		return "Forward Observer"
+	}
+	return role.String()
+}
+
+// fields of compressed TAKPackets holding unishox2 encoded strings
+var takCompressedFields = map[protowire.Number][]protowire.Number{
+	2: {1, 2},    // Contact callsign and device callsign
+	6: {1, 2, 3}, // GeoChat message, to and to callsign
+}
+
+// UnmarshalTAKPacket parses a TAKPacket. The unishox2 encoded strings of a
+// compressed packet are decompressed first, as they aren't valid UTF-8.
+func UnmarshalTAKPacket(payload []byte) (*generated.TAKPacket, error) {
+	if isCompressedTAKPacket(payload) {
+		var err error
+		payload, err = rewriteBytesFields(payload, func(num protowire.Number, value []byte) ([]byte, error) {
+			subfields := takCompressedFields[num]
+			if len(subfields) == 0 {
+				return value, nil
+			}
+			return rewriteBytesFields(value, func(subfield protowire.Number, value []byte) ([]byte, error) {
+				if !slices.Contains(subfields, subfield) {
+					return value, nil
+				}
+				text, err := UnishoxDecompress(value)
+				if err != nil {
+					return nil, fmt.Errorf("field %v.%v: %w", num, subfield, err)
+				}
+				return text, nil
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	tak := new(generated.TAKPacket)
+	if err := proto.Unmarshal(payload, tak); err != nil {
+		return nil, err
+	}
+	return tak, nil
+}
+
+// isCompressedTAKPacket reads the is_compressed field of an encoded TAKPacket.
+func isCompressedTAKPacket(payload []byte) bool {
+	compressed := false
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return false
+		}
+		payload = payload[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(payload)
+			if n < 0 {
+				return false
+			}
+			compressed = v != 0
+		}
+		n = protowire.ConsumeFieldValue(num, typ, payload)
+		if n < 0 {
+			return false
+		}
+		payload = payload[n:]
+	}
+	return compressed
+}
+
+// rewriteBytesFields returns an encoded message with the contents of its
+// length-delimited fields replaced by the result of rewrite.
+func rewriteBytesFields(msg []byte, rewrite func(num protowire.Number, value []byte) ([]byte, error)) ([]byte, error) {
+	out := make([]byte, 0, len(msg))
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		if typ != protowire.BytesType {
+			out = append(out, msg[:n]...)
+			msg = msg[n:]
+			continue
+		}
+		value, _ := protowire.ConsumeBytes(msg)
+		msg = msg[n:]
+		value, err := rewrite(num, value)
+		if err != nil {
+			return nil, err
+		}
+		out = protowire.AppendBytes(out, value)
+	}
+	return out, nil
+}
+
+// Update applies a TAKPacket from a node received at now and returns the
+// updated entity, and the chat message if the packet was a GeoChat. Packets
+// older than the entity only add their chat message.
+func (db *TakDB) Update(nodeNum uint32, tak *generated.TAKPacket, now int64) (*TakEntity, *TakChat) {
+	entity := db.Entities[nodeNum]
+	if entity == nil {
+		entity = new(TakEntity)
+		db.Entities[nodeNum] = entity
+	}
+	if now >= entity.Updated {
+		entity.update(tak, now)
+	}
+	geoChat := tak.GetChat()
+	if geoChat == nil {
+		return entity, nil
+	}
+	chat := &TakChat{
+		From:       nodeNum,
+		Callsign:   entity.Callsign,
+		To:         geoChat.GetTo(),
+		ToCallsign: geoChat.GetToCallsign(),
+		Message:    geoChat.GetMessage(),
+		Time:       now,
+	}
+	// keep the chats oldest first when replaying older packets
+	i := len(db.Chats)
+	for i > 0 && db.Chats[i-1].Time > now {
+		i--
+	}
+	db.Chats = slices.Insert(db.Chats, i, chat)
+	if len(db.Chats) > TakChatLimit {
+		db.Chats = db.Chats[len(db.Chats)-TakChatLimit:]
+	}
+	return entity, chat
+}
+
+func (entity *TakEntity) update(tak *generated.TAKPacket, now int64) {
+	entity.Updated = now
+	if contact := tak.GetContact(); contact != nil {
+		if callsign := contact.GetCallsign(); len(callsign) > 0 {
+			entity.Callsign = callsign
+		}
+		if deviceCallsign := contact.GetDeviceCallsign(); len(deviceCallsign) > 0 {
+			entity.DeviceCallsign = deviceCallsign
+		}
+	}
+	if group := tak.GetGroup(); group != nil {
+		entity.Team = teamName(group.GetTeam())
+		entity.Role = roleName(group.GetRole())
+	}
+	if status := tak.GetStatus(); status != nil {
+		entity.Battery = status.GetBattery()
+	}
+	if pli := tak.GetPli(); pli != nil && (pli.GetLatitudeI() != 0 || pli.GetLongitudeI() != 0) {
+		entity.Latitude = pli.GetLatitudeI()
+		entity.Longitude = pli.GetLongitudeI()
+		entity.Altitude = pli.GetAltitude()
+		entity.Speed = pli.GetSpeed()
+		entity.Course = pli.GetCourse()
+		entity.LastPli = now
+	}
+}
+
+// Prune removes entities and chat messages not updated within ttl.
+func (db *TakDB) Prune(ttl int64) {
+	now := time.Now().Unix()
+	for nodeNum, entity := range db.Entities {
+		if entity.Updated+ttl < now {
+			delete(db.Entities, nodeNum)
+		}
+	}
+	for len(db.Chats) > 0 && db.Chats[0].Time+ttl < now {
+		db.Chats = db.Chats[1:]
+	}
+}
@@ -0,0 +1,78 @@
+package meshtastic
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/brianshea2/meshmap.net/internal/meshtastic/generated"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// compressedTAKPacket encodes a compressed TAKPacket the way the firmware
+// does, which proto.Marshal refuses as the strings aren't valid UTF-8.
+func compressedTAKPacket(callsign, deviceCallsign, message, to string) []byte {
+	var contact, chat, packet []byte
+	contact = protowire.AppendTag(contact, 1, protowire.BytesType)
+	contact = protowire.AppendBytes(contact, UnishoxCompress([]byte(callsign)))
+	contact = protowire.AppendTag(contact, 2, protowire.BytesType)
+	contact = protowire.AppendBytes(contact, UnishoxCompress([]byte(deviceCallsign)))
+	chat = protowire.AppendTag(chat, 1, protowire.BytesType)
+	chat = protowire.AppendBytes(chat, UnishoxCompress([]byte(message)))
+	chat = protowire.AppendTag(chat, 2, protowire.BytesType)
+	chat = protowire.AppendBytes(chat, UnishoxCompress([]byte(to)))
+	packet = protowire.AppendTag(packet, 1, protowire.VarintType)
+	packet = protowire.AppendVarint(packet, 1)
+	packet = protowire.AppendTag(packet, 2, protowire.BytesType)
+	packet = protowire.AppendBytes(packet, contact)
+	packet = protowire.AppendTag(packet, 4, protowire.BytesType)
+	packet = protowire.AppendBytes(packet, protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 87))
+	packet = protowire.AppendTag(packet, 6, protowire.BytesType)
+	packet = protowire.AppendBytes(packet, chat)
+	return packet
+}
+
+func TestUnmarshalTAKPacket(t *testing.T) {
+	callsign, deviceCallsign := "Runner Ünö", "ANDROID-0123456789abcdef"
+	message, to := "Water station 3 is out of cups \U0001f6b0", "All Chat Rooms"
+	compressed := compressedTAKPacket(callsign, deviceCallsign, message, to)
+	plain, err := proto.Marshal(&generated.TAKPacket{
+		Contact:        &generated.Contact{Callsign: callsign, DeviceCallsign: deviceCallsign},
+		Status:         &generated.Status{Battery: 87},
+		PayloadVariant: &generated.TAKPacket_Chat{Chat: &generated.GeoChat{Message: message, To: &to}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, payload := range map[string][]byte{"compressed": compressed, "plain": plain} {
+		tak, err := UnmarshalTAKPacket(payload)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if tak.GetContact().GetCallsign() != callsign ||
+			tak.GetContact().GetDeviceCallsign() != deviceCallsign ||
+			tak.GetChat().GetMessage() != message ||
+			tak.GetChat().GetTo() != to ||
+			tak.GetStatus().GetBattery() != 87 {
+			t.Errorf("%v: got %v", name, tak)
+		}
+	}
+}
+
+func TestUnmarshalTAKPacketMalformed(t *testing.T) {
+	compressed := compressedTAKPacket("a", "b", "c", "d")
+	for n := range len(compressed) {
+		UnmarshalTAKPacket(compressed[:n]) // must not panic
+	}
+	// a callsign with a dictionary copy from before the start of the output
+	contact := protowire.AppendTag(nil, 1, protowire.BytesType)
+	contact = protowire.AppendBytes(contact, []byte{0xd1, 0x80})
+	bad := protowire.AppendTag(nil, 1, protowire.VarintType)
+	bad = protowire.AppendVarint(bad, 1)
+	bad = protowire.AppendTag(bad, 2, protowire.BytesType)
+	bad = protowire.AppendBytes(bad, contact)
+	if _, err := UnmarshalTAKPacket(bad); !errors.Is(err, ErrUnishox) {
+		t.Errorf("got %v, want %v", err, ErrUnishox)
+	}
+}
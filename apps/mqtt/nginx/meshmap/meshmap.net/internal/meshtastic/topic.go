@@ -0,0 +1,72 @@
+package meshtastic
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// formats of the topics gateways publish to
+const (
+	TopicFormatEncrypted = "e"    // protobuf ServiceEnvelope
+	TopicFormatMap       = "map"  // protobuf ServiceEnvelope with a MapReport
+	TopicFormatJSON      = "json" // JSON, not handled by MQTTClient
+)
+
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// Topic is a parsed msh/<root...>/2/e/<channel>/!<gateway>,
+// msh/<root...>/2/json/<channel>/!<gateway> or msh/<root...>/2/map/ topic.
+type Topic struct {
+	Root    string // e.g. msh/US/NY
+	Region  string // first level below msh, e.g. US
+	Format  string
+	Channel string // empty for map reports
+	Gateway string // empty for map reports
+}
+
+func isNodeId(s string) bool {
+	if len(s) < 2 || s[0] != '!' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func ParseTopic(topic string) (*Topic, error) {
+	parts := strings.Split(topic, "/")
+	n := len(parts)
+	if n < 4 || parts[0] != "msh" {
+		return nil, ErrInvalidTopic
+	}
+	var root []string
+	parsed := new(Topic)
+	switch {
+	case n >= 6 && parts[n-4] == "2" && (parts[n-3] == TopicFormatEncrypted || parts[n-3] == TopicFormatJSON):
+		root = parts[:n-4]
+		parsed.Format = parts[n-3]
+		parsed.Channel = parts[n-2]
+		parsed.Gateway = parts[n-1]
+		if len(parsed.Channel) == 0 || !isNodeId(parsed.Gateway) {
+			return nil, ErrInvalidTopic
+		}
+	case n >= 5 && parts[n-3] == "2" && parts[n-2] == TopicFormatMap && parts[n-1] == "":
+		root = parts[:n-3]
+		parsed.Format = TopicFormatMap
+	case parts[n-2] == "2" && parts[n-1] == TopicFormatMap:
+		root = parts[:n-2]
+		parsed.Format = TopicFormatMap
+	default:
+		return nil, ErrInvalidTopic
+	}
+	if len(root) < 2 || slices.Contains(root, "") {
+		return nil, ErrInvalidTopic
+	}
+	parsed.Root = strings.Join(root, "/")
+	parsed.Region = root[1]
+	return parsed, nil
+}
@@ -0,0 +1,251 @@
+package meshtastic
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TrackPointLimit = 2000 // per node
+
+// TrackPoint is a position in a node's breadcrumb track.
+type TrackPoint struct {
+	Latitude  int32   `json:"latitude"`
+	Longitude int32   `json:"longitude"`
+	Altitude  int32   `json:"altitude,omitempty"`
+	Speed     *uint32 `json:"speed,omitempty"` // m/s
+	PoorFix   bool    `json:"poorFix,omitempty"`
+	Time      int64   `json:"time"`
+}
+
+// TrackDB holds the breadcrumb tracks of the nodes allowed to be tracked,
+// oldest point first. No node is tracked until allowed with SetAllowed.
+type TrackDB struct {
+	tracks  map[uint32][]*TrackPoint
+	allowed NodeSet
+	dirty   map[uint32]bool // changed since the last WriteDir
+	changed bool            // since the last WriteFile
+	swept   bool            // files of tracks no longer held removed
+}
+
+func NewTrackDB() *TrackDB {
+	return &TrackDB{
+		tracks: make(map[uint32][]*TrackPoint),
+		dirty:  make(map[uint32]bool),
+	}
+}
+
+// SetAllowed sets the nodes to keep tracks of, dropping the tracks of others.
+func (db *TrackDB) SetAllowed(nodes NodeSet) {
+	db.allowed = nodes
+	for nodeNum := range db.tracks {
+		if _, found := nodes[nodeNum]; !found {
+			db.remove(nodeNum)
+		}
+	}
+}
+
+func (db *TrackDB) remove(nodeNum uint32) {
+	delete(db.tracks, nodeNum)
+	db.dirty[nodeNum] = true
+	db.changed = true
+}
+
+// Len returns the number of tracked nodes.
+func (db *TrackDB) Len() int {
+	return len(db.tracks)
+}
+
+// Add appends a position to the track of an allowed node, unless the node
+// moved less than minDistance m within minInterval s of the last point.
+func (db *TrackDB) Add(nodeNum uint32, point *TrackPoint, minDistance float64, minInterval int64) bool {
+	if _, found := db.allowed[nodeNum]; !found {
+		return false
+	}
+	track := db.tracks[nodeNum]
+	if len(track) > 0 {
+		last := track[len(track)-1]
+		if point.Time < last.Time {
+			return false
+		}
+		if point.Time-last.Time < minInterval &&
+			Distance(last.Latitude, last.Longitude, point.Latitude, point.Longitude) < minDistance {
+			return false
+		}
+	}
+	track = append(track, point)
+	if len(track) > TrackPointLimit {
+		track = track[len(track)-TrackPointLimit:]
+	}
+	db.tracks[nodeNum] = track
+	db.dirty[nodeNum] = true
+	db.changed = true
+	return true
+}
+
+func (db *TrackDB) Prune(ttl int64) {
+	now := time.Now().Unix()
+	for nodeNum, track := range db.tracks {
+		pruned := track
+		for len(pruned) > 0 && pruned[0].Time+ttl < now {
+			pruned = pruned[1:]
+		}
+		switch {
+		case len(pruned) == 0:
+			db.remove(nodeNum)
+		case len(pruned) < len(track):
+			db.tracks[nodeNum] = pruned
+			db.dirty[nodeNum] = true
+			db.changed = true
+		}
+	}
+}
+
+// LoadFile loads tracks written by WriteFile. They are all written out again
+// by the next WriteDir.
+func (db *TrackDB) LoadFile(path string) error {
+	if err := LoadJSONFile(path, &db.tracks); err != nil {
+		return err
+	}
+	if db.tracks == nil {
+		db.tracks = make(map[uint32][]*TrackPoint)
+	}
+	for nodeNum := range db.tracks {
+		db.dirty[nodeNum] = true
+	}
+	return nil
+}
+
+// WriteFile writes all tracks to path, if they changed since the last write.
+func (db *TrackDB) WriteFile(path string) error {
+	if !db.changed {
+		return nil
+	}
+	if err := WriteJSONFile(path, db.tracks); err != nil {
+		return err
+	}
+	db.changed = false
+	return nil
+}
+
+// WriteDir writes each track changed since the last call to dir as <node
+// number>.json and .gpx, named after the node in nodes, and removes the files
+// of tracks no longer held.
+func (db *TrackDB) WriteDir(dir string, nodes NodeDB) error {
+	if !db.swept {
+		if err := db.sweepDir(dir); err != nil {
+			return err
+		}
+		db.swept = true
+	}
+	if len(db.dirty) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for nodeNum := range db.dirty {
+		base := filepath.Join(dir, strconv.FormatUint(uint64(nodeNum), 10))
+		track := db.tracks[nodeNum]
+		if len(track) == 0 {
+			for _, path := range []string{base + ".json", base + ".gpx"} {
+				if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+			}
+			delete(db.dirty, nodeNum)
+			continue
+		}
+		name := NodeId(nodeNum)
+		if node := nodes[nodeNum]; node != nil && len(node.LongName) > 0 {
+			name = node.LongName
+		}
+		if err := WriteJSONFile(base+".json", track); err != nil {
+			return err
+		}
+		err := writeFile(base+".gpx", 0644, func(w io.Writer) error {
+			return writeGPX(w, name, track)
+		})
+		if err != nil {
+			return err
+		}
+		delete(db.dirty, nodeNum)
+	}
+	return nil
+}
+
+// sweepDir removes the track files of nodes without a track.
+func (db *TrackDB) sweepDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, entry := range entries {
+		num, ext, found := strings.Cut(entry.Name(), ".")
+		if !found || (ext != "json" && ext != "gpx") {
+			continue
+		}
+		nodeNum, err := strconv.ParseUint(num, 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := db.tracks[uint32(nodeNum)]; !ok {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+type gpx struct {
+	XMLName xml.Name `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string          `xml:"name"`
+	Segment []gpxTrackPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxTrackPoint struct {
+	Lat  string `xml:"lat,attr"`
+	Lon  string `xml:"lon,attr"`
+	Ele  *int32 `xml:"ele,omitempty"`
+	Time string `xml:"time"`
+}
+
+func writeGPX(w io.Writer, name string, track []*TrackPoint) error {
+	doc := gpx{
+		Version: "1.1",
+		Creator: "meshmap.net",
+		Track:   gpxTrack{Name: name, Segment: make([]gpxTrackPoint, 0, len(track))},
+	}
+	for _, point := range track {
+		trkpt := gpxTrackPoint{
+			Lat:  strconv.FormatFloat(float64(point.Latitude)/1e7, 'f', -1, 64),
+			Lon:  strconv.FormatFloat(float64(point.Longitude)/1e7, 'f', -1, 64),
+			Time: time.Unix(point.Time, 0).UTC().Format(time.RFC3339),
+		}
+		if point.Altitude != 0 {
+			trkpt.Ele = &point.Altitude
+		}
+		doc.Track.Segment = append(doc.Track.Segment, trkpt)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("failed to encode GPX: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,852 @@
+package meshtastic
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// Unishox2 with the default preset, as used by the firmware for
+// TEXT_MESSAGE_COMPRESSED_APP payloads. Codes are kept left-aligned in a byte,
+// with their length in bits alongside, like the reference implementation.
+
+var ErrUnishox = errors.New("invalid unishox2 data")
+
+const (
+	usxAlpha = iota
+	usxSym
+	usxNum
+	usxDict
+	usxDelta
+)
+
+const (
+	usxNiceLen      = 5    // shortest dictionary match
+	usxMaxCount     = 4771 // largest count that can be encoded
+	usxMaxOutputLen = 4096 // guards against crafted payloads expanding without bound
+	// vertical codes with special meanings
+	usxCrlf     = 8  // in the symbol set
+	usxRpt      = 26 // in the number set
+	usxTerm     = 27 // in the number set
+	usxNumSpace = 17
+)
+
+var (
+	usxHcodes    = []byte{0x00, 0x40, 0x80, 0xC0, 0xE0}
+	usxHcodeLens = []byte{2, 2, 2, 3, 3}
+	usxVcodes    = []byte{
+		0x00, 0x40, 0x60, 0x80, 0x90, 0xA0, 0xB0,
+		0xC0, 0xD0, 0xD8, 0xE0, 0xE4, 0xE8, 0xEC,
+		0xEE, 0xF0, 0xF2, 0xF4, 0xF6, 0xF7, 0xF8,
+		0xF9, 0xFA, 0xFB, 0xFC, 0xFD, 0xFE, 0xFF,
+	}
+	usxVcodeLens = []byte{
+		2, 3, 3, 4, 4, 4, 4,
+		4, 5, 5, 6, 6, 6, 7,
+		7, 7, 7, 7, 8, 8, 8,
+		8, 8, 8, 8, 8, 8, 8,
+	}
+	// zero entries are switch and special codes
+	usxSets = [3][28]byte{
+		{0, ' ', 'e', 't', 'a', 'o', 'i', 'n',
+			's', 'r', 'l', 'c', 'd', 'h', 'u', 'p', 'm', 'b',
+			'g', 'w', 'f', 'y', 'v', 'k', 'q', 'j', 'x', 'z'},
+		{'"', '{', '}', '_', '<', '>', ':', '\n',
+			0, '[', ']', '\\', ';', '\'', '\t', '@', '*', '&',
+			'?', '!', '^', '|', '\r', '~', '`', 0, 0, 0},
+		{0, ',', '.', '0', '1', '9', '2', '5', '-',
+			'/', '3', '4', '6', '7', '8', '(', ')', ' ',
+			'=', '+', '$', '%', '#', 0, 0, 0, 0, 0},
+	}
+	// frequent sequences, and their codes: the last symbols, then the last numbers before usxRpt
+	usxFreqSeqs  = []string{"\": \"", "\": ", "</", "=\"", "\":\"", "://"}
+	usxFreqCodes = []byte{usxSym<<5 + 25, usxSym<<5 + 26, usxSym<<5 + 27, usxNum<<5 + 23, usxNum<<5 + 24, usxNum<<5 + 25}
+	// f and F are lower and upper case hex digits, r, t and o are digits up to 7, 3 and 1
+	usxTemplates = []string{"tfff-of-tfTtf:rf:rf.fffZ", "tfff-of-tf", "(fff) fff-ffff", "tf:rf:rf"}
+	// count and unicode delta sizes, by step code
+	usxCountBits = []int{2, 5, 7, 9, 12}
+	usxCountAdd  = []int{0, 4, 36, 164, 676}
+	usxUniBits   = []int{6, 12, 14, 16, 21}
+	usxUniAdd    = []int32{0, 64, 4160, 20544, 86080}
+	// set (upper 3 bits) and vertical code (lower 5 bits) of printable ASCII, from '!'
+	usxCode94 [94]byte
+)
+
+func init() {
+	for h := range usxSets {
+		for v, c := range usxSets[h] {
+			if c <= ' ' {
+				continue
+			}
+			usxCode94[c-'!'] = byte(h<<5 + v)
+			if c >= 'a' && c <= 'z' {
+				usxCode94[c-'a'+'A'-'!'] = byte(h<<5 + v)
+			}
+		}
+	}
+}
+
+const (
+	usxNibNot = iota
+	usxNibNum
+	usxNibLower
+	usxNibUpper
+)
+
+func nibbleType(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return usxNibNum
+	case c >= 'a' && c <= 'f':
+		return usxNibLower
+	case c >= 'A' && c <= 'F':
+		return usxNibUpper
+	}
+	return usxNibNot
+}
+
+func nibbleValue(c byte) int {
+	switch nibbleType(c) {
+	case usxNibNum:
+		return int(c - '0')
+	case usxNibLower:
+		return int(c-'a') + 10
+	case usxNibUpper:
+		return int(c-'A') + 10
+	}
+	return 0
+}
+
+func hexChar(nibble int, upper bool) byte {
+	switch {
+	case nibble < 10:
+		return byte('0' + nibble)
+	case upper:
+		return byte('A' + nibble - 10)
+	}
+	return byte('a' + nibble - 10)
+}
+
+type usxReader struct {
+	in  []byte
+	pos int // in bits
+}
+
+func (r *usxReader) done() bool {
+	return r.pos >= len(r.in)*8
+}
+
+func (r *usxReader) readBits(n int) (int, bool) {
+	if r.pos+n > len(r.in)*8 {
+		return 0, false
+	}
+	v := 0
+	for range n {
+		v = v<<1 | int(r.in[r.pos>>3]>>(7-r.pos&7)&1)
+		r.pos++
+	}
+	return v, true
+}
+
+// readStep reads a code of up to limit one bits, ended by a zero bit if shorter.
+func (r *usxReader) readStep(limit int) (int, bool) {
+	n := 0
+	for n < limit {
+		b, ok := r.readBits(1)
+		if !ok {
+			return 0, false
+		}
+		if b == 0 {
+			break
+		}
+		n++
+	}
+	return n, true
+}
+
+// readCode reads a prefix code and returns its index in codes.
+func (r *usxReader) readCode(codes, lens []byte) (int, bool) {
+	v := 0
+	for n := 1; n <= 8; n++ {
+		b, ok := r.readBits(1)
+		if !ok {
+			return 0, false
+		}
+		v = v<<1 | b
+		for i, code := range codes {
+			if int(lens[i]) == n && int(code)>>(8-n) == v {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (r *usxReader) readCount() (int, bool) {
+	i, ok := r.readStep(4)
+	if !ok {
+		return 0, false
+	}
+	v, ok := r.readBits(usxCountBits[i])
+	return v + usxCountAdd[i], ok
+}
+
+// readUnicode returns a code point delta, or the index of a special code.
+func (r *usxReader) readUnicode() (delta int32, special int, ok bool) {
+	i, ok := r.readStep(5)
+	if !ok {
+		return 0, 0, false
+	}
+	if i == 5 {
+		special, ok = r.readStep(4)
+		return 0, special, ok
+	}
+	sign, ok := r.readBits(1)
+	if !ok {
+		return 0, 0, false
+	}
+	v, ok := r.readBits(usxUniBits[i])
+	delta = int32(v) + usxUniAdd[i]
+	if sign == 1 {
+		delta = -delta
+	}
+	return delta, -1, ok
+}
+
+// UnishoxDecompress decodes Unishox2 data compressed with the default preset.
+// Truncated trailing codes, like the padding of the last byte, end the output.
+func UnishoxDecompress(in []byte) ([]byte, error) {
+	r := &usxReader{in: in, pos: 1} // skip the magic bit
+	out := make([]byte, 0, len(in)*2)
+	dstate, h := usxAlpha, usxAlpha
+	isAllUpper := false
+	var prevUni int32
+	for !r.done() {
+		if len(out) > usxMaxOutputLen {
+			return nil, ErrUnishox
+		}
+		if dstate == usxDelta || h == usxDelta {
+			if dstate != usxDelta {
+				h = dstate // a single character
+			}
+			delta, special, ok := r.readUnicode()
+			if !ok {
+				break
+			}
+			switch special {
+			case -1:
+				prevUni += delta
+				if prevUni < 0 || prevUni > utf8.MaxRune {
+					return nil, ErrUnishox
+				}
+				out = utf8.AppendRune(out, rune(prevUni))
+				continue
+			case 0:
+				out = append(out, ' ')
+				continue
+			case 1:
+				// switch out of the delta state, or to a set for one character
+				if h, ok = r.readCode(usxHcodes, usxHcodeLens); !ok {
+					return out, nil
+				}
+				switch h {
+				case usxAlpha, usxDelta:
+					dstate = h
+					continue
+				case usxDict:
+					var err error
+					if out, err = r.copyDict(out); err != nil {
+						return nil, err
+					}
+					continue
+				}
+			case 2:
+				out = append(out, ',')
+				continue
+			case 3:
+				out = append(out, '.')
+				continue
+			case 4:
+				out = append(out, '\n')
+				continue
+			}
+		} else {
+			h = dstate
+		}
+		isUpper := isAllUpper
+		v, ok := r.readCode(usxVcodes, usxVcodeLens)
+		if !ok {
+			break
+		}
+		if v == 0 && h != usxSym {
+			if r.done() {
+				break
+			}
+			// after switching out of the delta state the set is already known
+			if h != usxNum || dstate != usxDelta {
+				if h, ok = r.readCode(usxHcodes, usxHcodeLens); !ok || r.done() {
+					break
+				}
+			}
+			switch h {
+			case usxAlpha:
+				if dstate != usxAlpha {
+					dstate = usxAlpha
+					continue
+				}
+				if isAllUpper {
+					isAllUpper = false
+					continue
+				}
+				// upper case for the next letter, or all letters if repeated
+				if v, ok = r.readCode(usxVcodes, usxVcodeLens); !ok {
+					return out, nil
+				}
+				if v == 0 {
+					if h, ok = r.readCode(usxHcodes, usxHcodeLens); !ok {
+						return out, nil
+					}
+					if h != usxAlpha {
+						return nil, ErrUnishox
+					}
+					isAllUpper = true
+					continue
+				}
+				isUpper = true
+			case usxDict:
+				var err error
+				if out, err = r.copyDict(out); err != nil {
+					return nil, err
+				}
+				continue
+			case usxDelta:
+				continue
+			default:
+				if h != usxNum || dstate != usxDelta {
+					if v, ok = r.readCode(usxVcodes, usxVcodeLens); !ok {
+						return out, nil
+					}
+				}
+			}
+		}
+		if h == usxNum && v == 0 {
+			var err error
+			if out, ok, err = r.readNibbles(out); err != nil {
+				return nil, err
+			} else if !ok {
+				break
+			}
+			if dstate == usxDelta {
+				h = usxDelta
+			}
+			continue
+		}
+		c := usxSets[h][v]
+		switch {
+		case c >= 'a' && c <= 'z':
+			if isUpper {
+				c -= 'a' - 'A'
+			}
+			out = append(out, c)
+		case c >= '0' && c <= '9':
+			out = append(out, c)
+			dstate = usxNum
+		case c != 0:
+			out = append(out, c)
+		case h == usxSym && v == usxCrlf:
+			out = append(out, '\r', '\n')
+		case h == usxSym && v > 24:
+			out = append(out, usxFreqSeqs[v-25]...)
+		case h == usxNum && v > 22 && v < usxRpt:
+			out = append(out, usxFreqSeqs[v-20]...)
+		case h == usxNum && v == usxRpt:
+			count, ok := r.readCount()
+			if !ok {
+				return out, nil
+			}
+			if len(out) == 0 || count+4 > usxMaxOutputLen {
+				return nil, ErrUnishox
+			}
+			for last, i := out[len(out)-1], 0; i < count+4; i++ {
+				out = append(out, last)
+			}
+		default: // usxTerm
+			return out, nil
+		}
+		if dstate == usxDelta {
+			h = usxDelta
+		}
+	}
+	return out, nil
+}
+
+// copyDict repeats earlier output.
+func (r *usxReader) copyDict(out []byte) ([]byte, error) {
+	length, ok := r.readCount()
+	if !ok {
+		return out, nil
+	}
+	dist, ok := r.readCount()
+	if !ok {
+		return out, nil
+	}
+	length += usxNiceLen
+	dist += usxNiceLen - 1
+	if dist > len(out) {
+		return nil, ErrUnishox
+	}
+	start := len(out) - dist
+	for i := range length {
+		out = append(out, out[start+i])
+	}
+	return out, nil
+}
+
+// readNibbles reads what follows a nibble escape: a template, hex digits, a
+// UUID or binary data. It reports false if the input ended.
+func (r *usxReader) readNibbles(out []byte) ([]byte, bool, error) {
+	kind, ok := r.readStep(5)
+	if !ok {
+		return out, false, nil
+	}
+	switch kind {
+	case 0:
+		i, ok := r.readStep(4)
+		if !ok {
+			return out, false, nil
+		}
+		if i >= len(usxTemplates) {
+			return nil, false, ErrUnishox
+		}
+		template := usxTemplates[i]
+		rem, ok := r.readCount()
+		if !ok {
+			return out, false, nil
+		}
+		if rem > len(template) {
+			return nil, false, ErrUnishox
+		}
+		for _, c := range []byte(template[:len(template)-rem]) {
+			bits := 0
+			switch c {
+			case 'f', 'F':
+				bits = 4
+			case 'r':
+				bits = 3
+			case 't':
+				bits = 2
+			case 'o':
+				bits = 1
+			}
+			if bits == 0 {
+				out = append(out, c)
+				continue
+			}
+			v, ok := r.readBits(bits)
+			if !ok {
+				return out, false, nil
+			}
+			out = append(out, hexChar(v, c == 'F'))
+		}
+	case 5:
+		count, ok := r.readCount()
+		if !ok {
+			return out, false, nil
+		}
+		if count == 0 {
+			return nil, false, ErrUnishox
+		}
+		for range count {
+			b, ok := r.readBits(8)
+			if !ok {
+				return out, false, nil
+			}
+			out = append(out, byte(b))
+		}
+	default:
+		// 1 and 3 are lower and upper case hex digits, 2 and 4 are UUIDs
+		count := 32
+		if kind == 1 || kind == 3 {
+			if count, ok = r.readCount(); !ok {
+				return out, false, nil
+			}
+			if count == 0 {
+				return nil, false, ErrUnishox
+			}
+		}
+		for ; count > 0; count-- {
+			nibble, ok := r.readBits(4)
+			if !ok {
+				return out, false, nil
+			}
+			out = append(out, hexChar(nibble, kind > 2))
+			if (kind == 2 || kind == 4) && (count == 25 || count == 21 || count == 17 || count == 13) {
+				out = append(out, '-')
+			}
+		}
+	}
+	return out, true, nil
+}
+
+type usxWriter struct {
+	out []byte
+	n   int // in bits
+}
+
+func (w *usxWriter) writeBits(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.out = append(w.out, 0)
+		}
+		if v>>i&1 == 1 {
+			w.out[w.n/8] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+func (w *usxWriter) writeCode(codes, lens []byte, i int) {
+	w.writeBits(int(codes[i])>>(8-lens[i]), int(lens[i]))
+}
+
+func (w *usxWriter) writeStep(n, limit int) {
+	w.writeBits(1<<n-1, n)
+	if n < limit {
+		w.writeBits(0, 1)
+	}
+}
+
+func (w *usxWriter) writeCount(count int) {
+	till := 0
+	for i, bits := range usxCountBits {
+		till += 1 << bits
+		if count < till {
+			w.writeStep(i, 4)
+			w.writeBits(count-usxCountAdd[i], bits)
+			return
+		}
+	}
+}
+
+func (w *usxWriter) writeUnicode(code, prev int32) {
+	diff := code - prev
+	if diff < 0 {
+		diff = -diff
+	}
+	var till int32
+	for i, bits := range usxUniBits {
+		till += 1 << bits
+		if diff < till {
+			w.writeStep(i, 5)
+			if prev > code {
+				w.writeBits(1, 1)
+			} else {
+				w.writeBits(0, 1)
+			}
+			w.writeBits(int(diff-usxUniAdd[i]), bits)
+			return
+		}
+	}
+}
+
+// writeSwitch switches sets, for the next character or until switching again.
+func (w *usxWriter) writeSwitch(set int) {
+	w.writeCode(usxVcodes, usxVcodeLens, 0)
+	w.writeCode(usxHcodes, usxHcodeLens, set)
+}
+
+// writeSetCode writes a character of usxSets, switching sets as needed.
+func (w *usxWriter) writeSetCode(code byte, state *int) {
+	h, v := int(code>>5), int(code&0x1F)
+	switch h {
+	case usxAlpha:
+		if *state != usxAlpha {
+			w.writeSwitch(usxAlpha)
+			*state = usxAlpha
+		}
+	case usxSym:
+		w.writeSwitch(usxSym)
+	case usxNum:
+		if *state != usxNum {
+			w.writeSwitch(usxNum)
+			if c := usxSets[h][v]; c >= '0' && c <= '9' {
+				*state = usxNum
+			}
+		}
+	}
+	w.writeCode(usxVcodes, usxVcodeLens, v)
+}
+
+func (w *usxWriter) writeNibbleEscape() {
+	w.writeSwitch(usxNum)
+	w.writeCode(usxVcodes, usxVcodeLens, 0)
+}
+
+// usxMatch finds the longest earlier occurrence of what follows in[l], longer
+// than usxNiceLen, returning its encoded length and distance.
+func usxMatch(in []byte, l int) (length, dist int, ok bool) {
+	for j := l - usxNiceLen; j >= 0 && l-j-usxNiceLen+1 <= usxMaxCount; j-- {
+		k := l
+		for k < len(in) && j+k-l < l && k-l-usxNiceLen < usxMaxCount && in[k] == in[j+k-l] {
+			k++
+		}
+		// don't end within a UTF-8 sequence
+		for k > l && k < len(in) && in[k]>>6 == 2 {
+			k--
+		}
+		if k-l-usxNiceLen > length {
+			length, dist, ok = k-l-usxNiceLen, l-j-usxNiceLen+1, true
+		}
+	}
+	return
+}
+
+// isUsxBinary reports whether in[l] can only be written as binary data.
+func isUsxBinary(in []byte, l int) bool {
+	c := in[l]
+	if (c >= ' ' && c < 0x7F) || c == '\t' || c == '\n' || c == '\r' {
+		return false
+	}
+	r, size := utf8.DecodeRune(in[l:])
+	return size < 2 || r == utf8.RuneError
+}
+
+// UnishoxCompress encodes in with Unishox2 and the default preset, for
+// decoders like the firmware's. Unicode characters are written one at a time,
+// so the output may be larger than the reference encoder's for non-Latin text.
+func UnishoxCompress(in []byte) []byte {
+	w := new(usxWriter)
+	w.writeBits(1, 1) // magic bit
+	state := usxAlpha
+	isAllUpper := false
+	var prevUni int32
+	for l := 0; l < len(in); l++ {
+		if l < len(in)-usxNiceLen+1 {
+			if length, dist, ok := usxMatch(in, l); ok {
+				w.writeSwitch(usxDict)
+				w.writeCount(length)
+				w.writeCount(dist)
+				l += length + usxNiceLen - 1
+				continue
+			}
+		}
+		c := in[l]
+		if l > 0 && l < len(in)-4 && c == in[l-1] && c == in[l+1] && c == in[l+2] && c == in[l+3] {
+			count := 4
+			for l+count < len(in) && in[l+count] == c && count-4 < usxMaxCount {
+				count++
+			}
+			w.writeSetCode(usxNum<<5+usxRpt, &state)
+			w.writeCount(count - 4)
+			l += count - 1
+			continue
+		}
+		if n := usxUuid(in, l); n != usxNibNot {
+			w.writeNibbleEscape()
+			if n == usxNibUpper {
+				w.writeStep(4, 5)
+			} else {
+				w.writeStep(2, 5)
+			}
+			for _, c := range in[l : l+36] {
+				if c != '-' {
+					w.writeBits(nibbleValue(c), 4)
+				}
+			}
+			l += 35
+			continue
+		}
+		if l < len(in)-5 {
+			hexType, hexLen := usxNibNum, 0
+			for l+hexLen < len(in) && hexLen < usxMaxCount {
+				t := nibbleType(in[l+hexLen])
+				if t == usxNibNot || (t != usxNibNum && hexType != usxNibNum && t != hexType) {
+					break
+				}
+				if t != usxNibNum {
+					hexType = t
+				}
+				hexLen++
+			}
+			if hexLen > 10 && hexType == usxNibNum {
+				hexType = usxNibLower
+			}
+			if hexType != usxNibNum && hexLen > 3 {
+				w.writeNibbleEscape()
+				if hexType == usxNibUpper {
+					w.writeStep(3, 5)
+				} else {
+					w.writeStep(1, 5)
+				}
+				w.writeCount(hexLen)
+				for _, c := range in[l : l+hexLen] {
+					w.writeBits(nibbleValue(c), 4)
+				}
+				l += hexLen - 1
+				continue
+			}
+		}
+		if i, matched := usxTemplate(in, l); matched > 0 {
+			template := usxTemplates[i]
+			w.writeNibbleEscape()
+			w.writeStep(0, 5)
+			w.writeStep(i, 4)
+			w.writeCount(len(template) - matched)
+			for k, t := range []byte(template[:matched]) {
+				switch t {
+				case 'f', 'F':
+					w.writeBits(nibbleValue(in[l+k]), 4)
+				case 'r':
+					w.writeBits(int(in[l+k]-'0'), 3)
+				case 't':
+					w.writeBits(int(in[l+k]-'0'), 2)
+				case 'o':
+					w.writeBits(int(in[l+k]-'0'), 1)
+				}
+			}
+			l += matched - 1
+			continue
+		}
+		if i := usxFreqSeq(in, l); i >= 0 {
+			w.writeSetCode(usxFreqCodes[i], &state)
+			l += len(usxFreqSeqs[i]) - 1
+			continue
+		}
+		isUpper := c >= 'A' && c <= 'Z'
+		if !isUpper && isAllUpper {
+			isAllUpper = false
+			w.writeSwitch(usxAlpha)
+			state = usxAlpha
+		}
+		if isUpper && !isAllUpper {
+			if state == usxNum {
+				w.writeSwitch(usxAlpha)
+				state = usxAlpha
+			}
+			w.writeSwitch(usxAlpha)
+			if l+5 < len(in) {
+				allUpper := true
+				for _, c := range in[l : l+6] {
+					allUpper = allUpper && c >= 'A' && c <= 'Z'
+				}
+				if allUpper {
+					w.writeSwitch(usxAlpha)
+					isAllUpper = true
+				}
+			}
+		}
+		switch {
+		case c == ' ':
+			if state == usxNum {
+				w.writeCode(usxVcodes, usxVcodeLens, usxNumSpace)
+			} else {
+				w.writeCode(usxVcodes, usxVcodeLens, 1)
+			}
+		case c > ' ' && c < 0x7F:
+			w.writeSetCode(usxCode94[c-'!'], &state)
+		case c == '\r' && l+1 < len(in) && in[l+1] == '\n':
+			w.writeSetCode(usxSym<<5+usxCrlf, &state)
+			l++
+		case c == '\n' || c == '\r' || c == '\t':
+			for v, s := range usxSets[usxSym] {
+				if s == c {
+					w.writeSetCode(byte(usxSym<<5+v), &state)
+				}
+			}
+		case !isUsxBinary(in, l):
+			r, size := utf8.DecodeRune(in[l:])
+			w.writeSwitch(usxDelta)
+			w.writeUnicode(r, prevUni)
+			prevUni = r
+			l += size - 1
+		default:
+			count := 1
+			for l+count < len(in) && count < usxMaxCount && isUsxBinary(in, l+count) {
+				count++
+			}
+			w.writeNibbleEscape()
+			w.writeStep(5, 5)
+			w.writeCount(count)
+			for _, b := range in[l : l+count] {
+				w.writeBits(int(b), 8)
+			}
+			l += count - 1
+		}
+	}
+	// terminate, then pad the last byte with the start of the terminator
+	n := w.n
+	if state != usxNum {
+		w.writeSwitch(usxNum)
+	}
+	w.writeCode(usxVcodes, usxVcodeLens, usxTerm)
+	return w.out[:(n+7)/8]
+}
+
+// usxUuid returns the nibble type of a UUID at in[l], or usxNibNot.
+func usxUuid(in []byte, l int) int {
+	if l+36 > len(in) {
+		return usxNibNot
+	}
+	hexType := usxNibNum
+	for i, c := range in[l : l+36] {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return usxNibNot
+			}
+			continue
+		}
+		t := nibbleType(c)
+		if t == usxNibNot || (t != usxNibNum && hexType != usxNibNum && t != hexType) {
+			return usxNibNot
+		}
+		if t != usxNibNum {
+			hexType = t
+		}
+	}
+	if hexType == usxNibNum {
+		return usxNibLower
+	}
+	return hexType
+}
+
+// usxTemplate returns the first template matching most of what follows in[l],
+// and how many of its characters match.
+func usxTemplate(in []byte, l int) (int, int) {
+	for i, template := range usxTemplates {
+		j := 0
+		for ; j < len(template) && l+j < len(in); j++ {
+			if !usxTemplateMatch(template[j], in[l+j]) {
+				break
+			}
+		}
+		if float32(j)/float32(len(template)) > 0.66 {
+			return i, j
+		}
+	}
+	return 0, 0
+}
+
+func usxTemplateMatch(t, c byte) bool {
+	switch t {
+	case 'f':
+		return nibbleType(c) == usxNibLower || nibbleType(c) == usxNibNum
+	case 'F':
+		return nibbleType(c) == usxNibUpper || nibbleType(c) == usxNibNum
+	case 'r':
+		return c >= '0' && c <= '7'
+	case 't':
+		return c >= '0' && c <= '3'
+	case 'o':
+		return c >= '0' && c <= '1'
+	}
+	return c == t
+}
+
+// usxFreqSeq returns the index of a frequent sequence at in[l], or -1.
+func usxFreqSeq(in []byte, l int) int {
+	for i, seq := range usxFreqSeqs {
+		if l+len(seq) <= len(in) && string(in[l:l+len(seq)]) == seq {
+			return i
+		}
+	}
+	return -1
+}
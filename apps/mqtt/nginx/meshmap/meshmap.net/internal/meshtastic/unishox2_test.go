@@ -0,0 +1,256 @@
+package meshtastic
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// usxBits packs a string of 0 and 1, ignoring spaces, into bytes padded with zeros.
+func usxBits(t *testing.T, bits string) []byte {
+	t.Helper()
+	bits = strings.ReplaceAll(bits, " ", "")
+	out := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		switch b {
+		case '1':
+			out[i/8] |= 0x80 >> (i % 8)
+		case '0':
+		default:
+			t.Fatalf("invalid bit %q", b)
+		}
+	}
+	return out
+}
+
+// Streams assembled by hand from the code tables of the reference
+// implementation's default preset, one group of bits per code:
+//   - the magic bit, 1
+//   - vertical codes of the alpha set: ' ' 010, e 011, o 1010, r 11011,
+//     l 111000, d 111010, h 1110110, w 11110111
+//   - the switch code (vertical code 0) 00, then a horizontal code:
+//     alpha 00 (upper case next letter), symbol 01, number 10, delta 111
+//   - number set: 1 1001, 2 1011, 3 111000, 0 1000; symbol set: ! 11110111
+//   - unicode deltas: a step code (0 or 10), a sign bit, then 6 or 12 bits
+//     less 0 or 64
+//
+// Streams captured from the C library or the firmware belong here too.
+var usxVectors = []struct {
+	name, bits, text string
+}{
+	{"empty", "1", ""},
+	{"lower case", "1 1110110 011 111000 111000 1010", "hello"},
+	{"upper case", "1 00 00 1110110 011 111000 111000 1010 010 00 00 11110111 1010 11011 111000 111010", "Hello World"},
+	{"numbers", "1 00 10 1001 1011 111000 1000", "1230"},
+	{"symbol", "1 111000 00 01 11110111 111000", "l!l"},
+	{"unicode", "1 00 111 10 0 000010101001", "é"},
+	{"unicode after text", "1 1010 00 111 10 0 000010101001 011", "oée"},
+	{"terminator", "1 1010 00 10 11111111 1010", "o"},
+}
+
+func TestUnishoxDecompressVectors(t *testing.T) {
+	for _, v := range usxVectors {
+		t.Run(v.name, func(t *testing.T) {
+			out, err := UnishoxDecompress(usxBits(t, v.bits))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != v.text {
+				t.Errorf("got %q, want %q", out, v.text)
+			}
+		})
+	}
+}
+
+// The encoder writes the same codes as the vectors, then a terminator cut
+// short at the end of the last byte instead of zero padding.
+func TestUnishoxCompressVectors(t *testing.T) {
+	for _, v := range usxVectors {
+		t.Run(v.name, func(t *testing.T) {
+			if v.name == "terminator" {
+				t.Skip("ends early on purpose")
+			}
+			bits := strings.ReplaceAll(v.bits, " ", "")
+			expected := usxBits(t, bits)
+			out := UnishoxCompress([]byte(v.text))
+			if len(out) != len(expected) {
+				t.Fatalf("got % x, want % x", out, expected)
+			}
+			// compare the codes, the padding may differ
+			mask := byte(0xff) << ((8 - len(bits)%8) % 8)
+			if !bytes.Equal(out[:len(out)-1], expected[:len(expected)-1]) || out[len(out)-1]&mask != expected[len(expected)-1]&mask {
+				t.Errorf("got % x, want % x", out, expected)
+			}
+		})
+	}
+}
+
+var usxSamples = []string{
+	"",
+	" ",
+	"a",
+	"Z",
+	"hello world",
+	"Hello World!",
+	"HELLO WORLD",
+	"DEF CON 32 is in LAS VEGAS, NV",
+	"camelCaseIdentifierWithNUMBERS123",
+	"The quick brown fox jumps over the lazy dog. THE QUICK BROWN FOX JUMPS OVER THE LAZY DOG.",
+	"Meet at the south entrance at 06:30, the run starts at 07:00 sharp.",
+	"https://meshtastic.org/docs/configuration/module/mqtt/",
+	"mailto:someone@example.com?subject=Hi%20there",
+	"{\"name\": \"meshmap\", \"nodes\": [1, 2, 3], \"ok\": true}",
+	"{\"a\":\"b\",\"c\":\"d\"}",
+	"<html><body><p class=\"x\">text</p></body></html>",
+	"key=\"value\" other=\"thing\"",
+	"2024-08-09T10:11:12.123Z",
+	"2024-08-09T10:11",
+	"(702) 555-0123",
+	"10:11:12",
+	"deadbeef 0123456789abcdef 0123456789ABCDEF",
+	"550e8400-e29b-41d4-a716-446655440000",
+	"!a1b2c3d4",
+	"3.14159265358979, -115.1728484, 36.1146995",
+	"$100 + 20% = #1 (really)",
+	"tab\tseparated\tvalues\r\nnext line\nlast line",
+	"\x00\x01\x02\x7f\x1b[0m binary\xff\xfe",
+	"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+	"!!!!!!!!!!!!!!!!!!!!",
+	"1111111111111111111111111",
+	"abcabcabcabcabcabcabcabcabcabc",
+	"repeat after me: repeat after me: repeat after me",
+	"café naïve résumé",
+	"ÉCOLE À PARIS",
+	"Привет, мир!",
+	"こんにちは世界",
+	"你好，世界。",
+	"\U0001f600\U0001f680\U0001f4e1 emoji \U0001f44d",
+	"mixed é世\U0001f600 scripts АБ and ASCII",
+	"السلام عليكم",
+	"\U0010ffff\u0080߿ࠀ￿",
+}
+
+func TestUnishoxRoundTrip(t *testing.T) {
+	for _, sample := range usxSamples {
+		compressed := UnishoxCompress([]byte(sample))
+		out, err := UnishoxDecompress(compressed)
+		if err != nil {
+			t.Errorf("%q: %v", sample, err)
+			continue
+		}
+		if string(out) != sample {
+			t.Errorf("%q: got %q from % x", sample, out, compressed)
+		}
+	}
+}
+
+func TestUnishoxRoundTripRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabets := []string{
+		"abcdefghijklmnopqrstuvwxyz      ",
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdef 0123456789",
+		"0123456789abcdefABCDEF-:.() ",
+		" !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~\t\r\n",
+		"aé世😀Ж ",
+	}
+	for i := 0; i < 2000; i++ {
+		var b []byte
+		n := rng.Intn(200)
+		switch i % 3 {
+		case 0: // arbitrary bytes
+			b = make([]byte, n)
+			rng.Read(b)
+		default: // text from a few alphabets
+			runes := []rune(alphabets[rng.Intn(len(alphabets))])
+			for range n {
+				b = utf8.AppendRune(b, runes[rng.Intn(len(runes))])
+			}
+		}
+		compressed := UnishoxCompress(b)
+		out, err := UnishoxDecompress(compressed)
+		if err != nil || !bytes.Equal(out, b) {
+			t.Fatalf("%q: got %q, %v from % x", b, out, err, compressed)
+		}
+	}
+}
+
+// Truncated input ends the output early, like the padding of the last byte.
+func TestUnishoxDecompressTruncated(t *testing.T) {
+	for _, sample := range usxSamples {
+		compressed := UnishoxCompress([]byte(sample))
+		for n := range len(compressed) {
+			out, err := UnishoxDecompress(compressed[:n])
+			if err != nil {
+				t.Errorf("%q cut to %v bytes: %v", sample, n, err)
+				continue
+			}
+			if len(out) > len(sample) {
+				t.Errorf("%q cut to %v bytes: got longer %q", sample, n, out)
+			}
+		}
+	}
+}
+
+// Corrupted and crafted input must fail or decode to something, never panic
+// or expand without bound.
+func TestUnishoxDecompressMalformed(t *testing.T) {
+	inputs := [][]byte{
+		{0x00},
+		{0xff},
+		bytes.Repeat([]byte{0x00}, 64),
+		bytes.Repeat([]byte{0xff}, 64),
+		bytes.Repeat([]byte{0xaa}, 64),
+		bytes.Repeat([]byte{0x55}, 64),
+		// a dictionary copy from before the start of the output
+		usxBits(t, "1 1010 00 110 0 00 0 00"),
+		// a repeat with nothing to repeat
+		usxBits(t, "1 00 10 11111110 0 00"),
+		// an unknown template
+		usxBits(t, "1 00 10 00 0 1111"),
+		// a unicode delta below zero
+		usxBits(t, "1 00 111 0 1 000001"),
+	}
+	for _, sample := range usxSamples {
+		compressed := UnishoxCompress([]byte(sample))
+		for i := range len(compressed) * 8 {
+			flipped := bytes.Clone(compressed)
+			flipped[i/8] ^= 0x80 >> (i % 8)
+			inputs = append(inputs, flipped)
+		}
+	}
+	rng := rand.New(rand.NewSource(2))
+	for range 5000 {
+		b := make([]byte, rng.Intn(64))
+		rng.Read(b)
+		inputs = append(inputs, b)
+	}
+	for _, in := range inputs {
+		out, err := UnishoxDecompress(in)
+		if err != nil && !errors.Is(err, ErrUnishox) {
+			t.Errorf("% x: unexpected error %v", in, err)
+		}
+		if len(out) > usxMaxOutputLen+utf8.UTFMax+usxMaxCount {
+			t.Errorf("% x: output of %v bytes", in, len(out))
+		}
+	}
+	for _, in := range inputs[6:10] {
+		if _, err := UnishoxDecompress(in); !errors.Is(err, ErrUnishox) {
+			t.Errorf("% x: got %v, want %v", in, err, ErrUnishox)
+		}
+	}
+}
+
+// Repeats and dictionary copies can't expand a small payload without bound.
+func TestUnishoxDecompressBounded(t *testing.T) {
+	// "a", then repeat it the most times a count allows, over and over
+	bits := "1 1001"
+	for range 20 {
+		bits += " 00 10 11111110 1111 111111111111"
+	}
+	if out, err := UnishoxDecompress(usxBits(t, bits)); !errors.Is(err, ErrUnishox) {
+		t.Errorf("expanded to %v bytes, err %v", len(out), err)
+	}
+}
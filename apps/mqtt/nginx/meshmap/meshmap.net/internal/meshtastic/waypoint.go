@@ -0,0 +1,94 @@
+package meshtastic
+
+import (
+	"time"
+)
+
+type Waypoint struct {
+	Id          uint32 `json:"id"`
+	From        uint32 `json:"from"`
+	Channel     string `json:"channel,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Icon        string `json:"icon,omitempty"`     // emoji
+	LockedTo    uint32 `json:"lockedTo,omitempty"` // only this node may change it
+	Expire      int64  `json:"expire,omitempty"`
+	Latitude    int32  `json:"latitude"`
+	Longitude   int32  `json:"longitude"`
+	Updated     int64  `json:"updated"`
+}
+
+func NewWaypoint(id, from uint32, channel, name, description string, icon, lockedTo, expire uint32, latitude, longitude int32, received int64) *Waypoint {
+	waypoint := &Waypoint{
+		Id:          id,
+		From:        from,
+		Channel:     channel,
+		Name:        name,
+		Description: description,
+		LockedTo:    lockedTo,
+		Expire:      int64(expire),
+		Latitude:    latitude,
+		Longitude:   longitude,
+		Updated:     received,
+	}
+	if icon != 0 {
+		waypoint.Icon = string(rune(icon))
+	}
+	return waypoint
+}
+
+func (waypoint *Waypoint) IsExpired(now int64) bool {
+	return waypoint.Expire > 0 && waypoint.Expire <= now
+}
+
+// WaypointResult is the outcome of WaypointDB.Update.
+type WaypointResult int
+
+const (
+	WaypointUpdated WaypointResult = iota // added, replaced or deleted
+	WaypointLocked                        // rejected, locked to another node
+	WaypointInvalid                       // ignored, no position
+	WaypointStale                         // ignored, older than the stored one
+)
+
+// WaypointDB maps waypoint IDs to waypoints.
+type WaypointDB map[uint32]*Waypoint
+
+// Update adds, replaces or, if already expired, deletes a waypoint, as the
+// apps do. Changes to a waypoint locked to another node are rejected.
+func (db WaypointDB) Update(waypoint *Waypoint) WaypointResult {
+	old := db[waypoint.Id]
+	if old != nil && old.Updated > waypoint.Updated {
+		return WaypointStale
+	}
+	if old != nil && old.LockedTo != 0 && old.LockedTo != waypoint.From {
+		return WaypointLocked
+	}
+	if waypoint.IsExpired(waypoint.Updated) {
+		delete(db, waypoint.Id)
+		return WaypointUpdated
+	}
+	if waypoint.Latitude == 0 && waypoint.Longitude == 0 {
+		return WaypointInvalid
+	}
+	db[waypoint.Id] = waypoint
+	return WaypointUpdated
+}
+
+// Prune removes expired waypoints, and waypoints without expiry not updated within ttl.
+func (db WaypointDB) Prune(ttl int64) {
+	now := time.Now().Unix()
+	for id, waypoint := range db {
+		if waypoint.IsExpired(now) || (waypoint.Expire == 0 && waypoint.Updated+ttl < now) {
+			delete(db, id)
+		}
+	}
+}
+
+func (db *WaypointDB) LoadFile(path string) error {
+	return LoadJSONFile(path, db)
+}
+
+func (db WaypointDB) WriteFile(path string) error {
+	return WriteJSONFile(path, db)
+}